@@ -0,0 +1,100 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Calendar alignment of snapshot times
+// With -align, snapshots are made at the start of calendar periods of the
+// shortest interval, e. g. at 00:00, 06:00, 12:00 and 18:00 for 6h, and
+// pruning keeps the first snapshot of each period of the longer intervals,
+// e. g. the one of Monday morning for a week.
+
+package main
+
+import (
+	"time"
+)
+
+// alignment describes where calendar periods start. A nil *alignment means
+// that snapshots are not aligned.
+type alignment struct {
+	offset time.Duration
+	loc    *time.Location
+}
+
+// alignment returns the alignment selected by the receiver, or nil if
+// -align is not set.
+func (c *Config) alignment() *alignment {
+	if !c.Align {
+		return nil
+	}
+	loc := time.Local
+	if c.AlignTZ != "" {
+		// the name has been checked when parsing the flags
+		if l, err := time.LoadLocation(c.AlignTZ); err == nil {
+			loc = l
+		}
+	}
+	return &alignment{c.AlignOffset, loc}
+}
+
+// civil converts a wall clock time into seconds since 1970-01-01 00:00 of the
+// same wall clock, ignoring time zones and daylight saving time.
+func civil(t time.Time) int64 {
+	y, m, d := t.Date()
+	days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	return days*86400 + int64(t.Hour()*3600+t.Minute()*60+t.Second())
+}
+
+// floorMod is the modulo operation rounding towards negative infinity.
+func floorMod(a, n int64) int64 {
+	return ((a % n) + n) % n
+}
+
+// weekEpoch is the first Monday after the unix epoch, weeks are counted from
+// there.
+var weekEpoch = int64(4 * 86400)
+
+// period returns the start of the period of length d that t falls into, and
+// the start of the following one. Multiples of years and months are calendar
+// years and months, multiples of weeks start on Monday, everything else is
+// counted in multiples of d from 1970-01-01 00:00 wall clock time, so periods
+// that divide a day start at midnight.
+func (al *alignment) period(t time.Time, d time.Duration) (time.Time, time.Time) {
+	w := t.In(al.loc).Add(-al.offset)
+	var start, next time.Time
+	switch {
+	case d%year == 0:
+		n := int64(d / year)
+		y := int64(w.Year())
+		y -= floorMod(y, n)
+		start = time.Date(int(y), 1, 1, 0, 0, 0, 0, al.loc)
+		next = start.AddDate(int(n), 0, 0)
+	case d%month == 0:
+		n := int64(d / month)
+		m := int64(w.Year())*12 + int64(w.Month()) - 1
+		m -= floorMod(m, n)
+		start = time.Date(int(m/12), time.Month(m%12+1), 1, 0, 0, 0, 0, al.loc)
+		next = start.AddDate(0, int(n), 0)
+	case d%week == 0:
+		s := civil(w) - weekEpoch
+		s -= floorMod(s, int64(d/time.Second))
+		s += weekEpoch
+		start = time.Date(1970, 1, 1, 0, 0, int(s), 0, al.loc)
+		next = start.AddDate(0, 0, int(d/day))
+	default:
+		secs := int64(d / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		s := civil(w)
+		s -= floorMod(s, secs)
+		start = time.Date(1970, 1, 1, 0, 0, int(s), 0, al.loc)
+		next = time.Date(1970, 1, 1, 0, 0, int(s+secs), 0, al.loc)
+	}
+	return start.Add(al.offset), next.Add(al.offset)
+}
+
+// samePeriod returns true if a and b fall into the same period of length d.
+func (al *alignment) samePeriod(a, b time.Time, d time.Duration) bool {
+	sa, _ := al.period(a, d)
+	sb, _ := al.period(b, d)
+	return sa.Equal(sb)
+}
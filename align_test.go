@@ -0,0 +1,128 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAlignPeriod(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	// Saturday
+	at := time.Date(2014, 5, 17, 16, 38, 51, 0, berlin)
+	tests := []struct {
+		al          alignment
+		d           time.Duration
+		start, next time.Time
+	}{
+		{alignment{0, berlin}, hour * 6,
+			time.Date(2014, 5, 17, 12, 0, 0, 0, berlin), time.Date(2014, 5, 17, 18, 0, 0, 0, berlin)},
+		{alignment{hour * 2, berlin}, hour * 6,
+			time.Date(2014, 5, 17, 14, 0, 0, 0, berlin), time.Date(2014, 5, 17, 20, 0, 0, 0, berlin)},
+		{alignment{0, time.UTC}, hour * 6,
+			time.Date(2014, 5, 17, 12, 0, 0, 0, time.UTC), time.Date(2014, 5, 17, 18, 0, 0, 0, time.UTC)},
+		{alignment{0, berlin}, minute * 10,
+			time.Date(2014, 5, 17, 16, 30, 0, 0, berlin), time.Date(2014, 5, 17, 16, 40, 0, 0, berlin)},
+		{alignment{0, berlin}, day,
+			time.Date(2014, 5, 17, 0, 0, 0, 0, berlin), time.Date(2014, 5, 18, 0, 0, 0, 0, berlin)},
+		{alignment{0, berlin}, week,
+			time.Date(2014, 5, 12, 0, 0, 0, 0, berlin), time.Date(2014, 5, 19, 0, 0, 0, 0, berlin)},
+		{alignment{0, berlin}, month,
+			time.Date(2014, 5, 1, 0, 0, 0, 0, berlin), time.Date(2014, 6, 1, 0, 0, 0, 0, berlin)},
+		{alignment{0, berlin}, month * 3,
+			time.Date(2014, 4, 1, 0, 0, 0, 0, berlin), time.Date(2014, 7, 1, 0, 0, 0, 0, berlin)},
+		{alignment{0, berlin}, year,
+			time.Date(2014, 1, 1, 0, 0, 0, 0, berlin), time.Date(2015, 1, 1, 0, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		start, next := tt.al.period(at, tt.d)
+		if !start.Equal(tt.start) || !next.Equal(tt.next) {
+			t.Errorf("period(%s, %s) with offset %s in %s got %s - %s, expected %s - %s",
+				at, tt.d, tt.al.offset, tt.al.loc, start, next, tt.start, tt.next)
+		}
+	}
+}
+
+func TestConfigAlignment(t *testing.T) {
+	c := &Config{AlignOffset: hour}
+	if c.alignment() != nil {
+		t.Error("got an alignment without -align")
+	}
+	c.Align = true
+	c.AlignTZ = "UTC"
+	al := c.alignment()
+	if al == nil || al.offset != hour || al.loc != time.UTC {
+		t.Errorf("got alignment %+v", al)
+	}
+}
+
+func TestSieveAligned(t *testing.T) {
+	intervals := intervalList{hour, hour * 6, day, long}
+	al := &alignment{0, time.UTC}
+	begin := time.Date(2014, 5, 17, 0, 30, 0, 0, time.UTC)
+	cl := newVirtualClock(begin.Unix())
+	var sl snapshotList
+	// hourly snapshots that are 30 minutes off the calendar
+	for i := 0; i < 24*4; i++ {
+		sl = append(sl, newSnapshot(cl.Now(), cl.Now().Add(time.Second), stateComplete))
+		cl.forward(time.Minute)
+		obsolete := make(map[*snapshot]bool)
+		for _, d := range sieve(sl, intervals, 0, al, nil, cl) {
+			obsolete[d.sn] = true
+		}
+		kept := sl[:0]
+		for _, sn := range sl {
+			if !obsolete[sn] {
+				kept = append(kept, sn)
+			}
+		}
+		sl = kept
+		cl.forward(hour - time.Minute)
+	}
+	// sieve leaves intervals with less than three snapshots alone, so the
+	// very first snapshots survive regardless of alignment
+	settled := begin.Add(hour * 6)
+	for _, sn := range sl.interval(intervals, 2, cl) {
+		if sn.startTime.After(settled) && sn.startTime.UTC().Hour() != 0 {
+			t.Errorf("kept %s in the daily interval, expected only the first snapshot of each day", sn.startTime.UTC())
+		}
+	}
+	for _, sn := range sl.interval(intervals, 1, cl) {
+		if sn.startTime.UTC().Hour()%6 != 0 {
+			t.Errorf("kept %s in the 6h interval, expected only the first snapshot of each 6h period", sn.startTime.UTC())
+		}
+	}
+	if n := len(sl.interval(intervals, 2, cl).period(settled, cl.Now())); n != 2 {
+		t.Errorf("kept %d snapshots in the daily interval, expected 2", n)
+	}
+}
+
+func TestNextWait(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	config.Schedule = "longterm"
+	cl := newVirtualClock(time.Date(2014, 5, 17, 16, 0, 0, 0, time.UTC).Unix())
+	sn := newSnapshot(time.Date(2014, 5, 17, 13, 10, 0, 0, time.UTC), time.Date(2014, 5, 17, 13, 20, 0, 0, time.UTC), stateComplete)
+	if got := nextWait(sn, cl); got != hour*3+minute*10 {
+		t.Errorf("nextWait() got %s without alignment, expected 3h10m", got)
+	}
+	config.Align = true
+	config.AlignTZ = "UTC"
+	if got := nextWait(sn, cl); got != hour*2 {
+		t.Errorf("nextWait() got %s with alignment, expected 2h", got)
+	}
+	config.AlignOffset = hour
+	if got := nextWait(sn, cl); got != hour*3 {
+		t.Errorf("nextWait() got %s with alignment offset 1h, expected 3h", got)
+	}
+	// overdue, e. g. after a restart
+	cl.forward(hour * 8)
+	if got := nextWait(sn, cl); got > 0 {
+		t.Errorf("nextWait() got %s for an overdue snapshot, expected no waiting", got)
+	}
+}
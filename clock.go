@@ -35,3 +35,21 @@ func newSkewClock(i int64) *skewClock {
 func (cl *skewClock) forward(d time.Duration) {
 	cl.skew -= d
 }
+
+// virtualClock only moves when it is told to. Used for simulations, where
+// the passing of real time must not have any influence.
+type virtualClock struct {
+	t time.Time
+}
+
+func (cl *virtualClock) Now() time.Time {
+	return cl.t
+}
+
+func newVirtualClock(i int64) *virtualClock {
+	return &virtualClock{t: time.Unix(i, 0)}
+}
+
+func (cl *virtualClock) forward(d time.Duration) {
+	cl.t = cl.t.Add(d)
+}
@@ -10,11 +10,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -31,30 +34,86 @@ func (o *opts) String() string {
 	return fmt.Sprintf("\"%s\"", strings.Join(*o, ""))
 }
 
-// opts setter
+// opts setter. The value is split at spaces, unless it is a JSON list like
+// ["--exclude=My Files", "--one-file-system"], which keeps the elements as
+// they are.
 func (o *opts) Set(value string) error {
+	if strings.HasPrefix(value, "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return err
+		}
+		*o = list
+		return nil
+	}
 	*o = strings.Split(value, " ")
 	return nil
 }
 
 // Config is used as a backing store for parsed flags
 type Config struct {
-	RsyncPath    string
-	RsyncOpts    opts
-	Origin       string
-	repository   string
-	Schedule     string
-	verbose      bool
-	showAll      bool
-	MaxKeep      int
-	NoPurge      bool
-	NoWait       bool
-	NoLogDate    bool
-	SchedFile    string
-	MinPercSpace float64
-	MinGiBSpace  int
-	Notify       string
-	noColor      bool
+	RsyncPath              string
+	RsyncOpts              opts
+	RsyncTimeout           time.Duration
+	RsyncNoProgressTimeout time.Duration
+	RsyncPolicy            string
+	RsyncRetries           int
+	RsyncRetryBackoff      time.Duration
+	Origin                 string
+	repository             string
+	Schedule               string
+	verbose                bool
+	showAll                bool
+	MaxKeep                int
+	NoPurge                bool
+	NoWait                 bool
+	NoLogDate              bool
+	SchedFile              string
+	MinPercSpace           float64
+	MinGiBSpace            int
+	Notify                 string
+	MetricsListen          string
+	PreHook                string
+	PostHook               string
+	PreHookFailure         string
+	MailBackend            string
+	MailFrom               string
+	SmtpHost               string
+	SmtpPort               int
+	SmtpStartTLS           bool
+	SmtpUser               string
+	SmtpPassword           string `json:"-"` // not written to the settings cache
+	WebhookURL             string `json:"-"` // may contain a token
+	WebhookTimeout         time.Duration
+	WebhookRetries         int
+	OverdueFactor          float64
+	Digest                 string
+	Align                  bool
+	AlignOffset            time.Duration
+	AlignTZ                string
+	noColor                bool
+	listFormat             string
+	jobsFile               string
+	configFile             string
+	jobArgs                []string
+	rsyncPolicy            map[int]rsyncAction
+	// options for the restore subcommand
+	restoreSnapshot string
+	restorePath     string
+	restoreDest     string
+	restoreDryRun   bool
+	restoreForce    bool
+	pruneDryRun     bool
+	pinSnapshot     string
+	ctlCommand      string
+	statusWarn      float64
+	statusCrit      float64
+	schedCheck      string
+	schedFormat     string
+	// options for the simulate subcommand
+	simDuration    time.Duration
+	simInitialSize int64
+	simDailyChange int64
 }
 
 // WriteCache writes the global configuration to disk as a json file.
@@ -88,7 +147,19 @@ func (c *Config) ReadCache() error {
 	c.RsyncOpts = t.RsyncOpts
 	if t.SchedFile != "" {
 		c.SchedFile = t.SchedFile
-		schedules.addFromFile(c.SchedFile)
+		// Only the schedule of the repository has to be valid. Schedule
+		// files that were accepted by earlier versions must not lock out
+		// restore and the like.
+		invalid, err := schedules.addValidFromFile(c.SchedFile)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, e := range invalid {
+			if e.schedule == t.Schedule {
+				return e
+			}
+			log.Println("ignoring invalid", e)
+		}
 	}
 	c.Origin = t.Origin
 	if _, ok := schedules[t.Schedule]; ok == false {
@@ -99,6 +170,9 @@ func (c *Config) ReadCache() error {
 	c.NoPurge = t.NoPurge
 	c.MinPercSpace = t.MinPercSpace
 	c.MinGiBSpace = t.MinGiBSpace
+	c.Align = t.Align
+	c.AlignOffset = t.AlignOffset
+	c.AlignTZ = t.AlignTZ
 	return nil
 }
 
@@ -111,14 +185,295 @@ Commands:
     run     Periodically create snapshots
     list    List snapshots
     scheds  List schedules
+    restore Copy data back out of a snapshot
+    pin     Protect a snapshot from pruning
+    unpin   Remove the protection from a pinned snapshot
+    prune   Mark and purge obsolete snapshots once, or show what would be done
+    simulate Forecast snapshot counts and disk usage for a schedule
+    ctl     Send a command to a running snaprd
+    status  Check the health of a repository, like a Nagios plugin
     help    Show usage instructions
 Use <command> -h to show possible options for <command>.
 Examples:
     %[1]s run -origin=fileserver:/export/projects -repository=/snapshots/projects
+    %[1]s run -config=/etc/snaprd/projects.toml
+    %[1]s run -jobsFile=/etc/snaprd.jobs
     %[1]s list -repository=/snapshots/projects
+    %[1]s prune -repository=/snapshots/projects -schedule=shortterm -dryRun
+    %[1]s pin -repository=/snapshots/projects "2014-05-17 16:38:51"
+    %[1]s scheds -check=/etc/snaprd.schedules
+    %[1]s simulate -schedule=longterm -duration=2y -dailyChange=5GiB -initialSize=500GiB
+    %[1]s status -repository=/snapshots/projects
+    %[1]s ctl -repository=/snapshots/projects snapshot-now
+    %[1]s restore -repository=/snapshots/projects -snapshot="2 ago" -path=docs -dest=/tmp/docs
 `, myName)
 }
 
+// newRunFlagSet returns the flags for the run subcommand, backed by config.
+func newRunFlagSet(config *Config) *flag.FlagSet {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.StringVar(&(config.RsyncPath),
+		"rsyncPath", "/usr/bin/rsync",
+		"path to rsync binary")
+	flags.Var(&(config.RsyncOpts),
+		"rsyncOpts",
+		"additional options for rsync")
+	flags.DurationVar(&(config.RsyncTimeout),
+		"rsyncTimeout", 0,
+		"if set, terminate rsync if it runs longer than this, e. g. \"12h\"")
+	flags.DurationVar(&(config.RsyncNoProgressTimeout),
+		"rsyncNoProgressTimeout", 0,
+		"if set, terminate rsync if it does not show any progress for this long. Unless -rsyncOpts contains a progress option, --info=progress2 is added, which needs rsync 3.1 or newer")
+	flags.StringVar(&(config.RsyncPolicy),
+		"rsyncPolicy", "",
+		"what to do on rsync exit codes, e. g. \"23:partial,24:accept,30:retry\". Actions are accept, partial, retry and fail")
+	flags.IntVar(&(config.RsyncRetries),
+		"rsyncRetries", 3,
+		"how often to retry rsync if the -rsyncPolicy says so")
+	flags.DurationVar(&(config.RsyncRetryBackoff),
+		"rsyncRetryBackoff", time.Minute,
+		"time to wait before the first retry of rsync. It doubles with every retry")
+	flags.StringVar(&(config.Origin),
+		"origin", "/tmp/snaprd_test/",
+		"data source")
+	flags.StringVar(&(config.repository),
+		"repository", defaultRepository,
+		"where to store snapshots")
+	flags.StringVar(&(config.repository),
+		"r", defaultRepository,
+		"(shorthand for -repository)")
+	flags.StringVar(&(config.Schedule),
+		"schedule", "longterm",
+		"one of "+schedules.String())
+	flags.IntVar(&(config.MaxKeep),
+		"maxKeep", 0,
+		"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
+	flags.BoolVar(&(config.Align),
+		"align", false,
+		"make snapshots at calendar boundaries of the first interval, e. g. 00:00, 06:00, ... for 6h, and keep the first snapshot of each day, week or month when pruning")
+	flags.DurationVar(&(config.AlignOffset),
+		"alignOffset", 0,
+		"shift the calendar boundaries used by -align, e. g. \"2h\" for 02:00, 08:00, ...")
+	flags.StringVar(&(config.AlignTZ),
+		"alignTZ", "",
+		"time zone for -align, e. g. \"Europe/Berlin\". Default is the local time zone")
+	flags.BoolVar(&(config.NoPurge),
+		"noPurge", false,
+		"if set, obsolete snapshots will not be deleted (minimum space requirements will still be honoured)")
+	flags.BoolVar(&(config.NoWait),
+		"noWait", false,
+		"if set, skip the initial waiting time before the first snapshot")
+	flags.BoolVar(&(config.NoLogDate),
+		"noLogDate", false,
+		"if set, does not print date and time in the log output. Useful if output is redirected to syslog")
+	flags.StringVar(&(config.SchedFile),
+		"schedFile", defaultSchedFileName,
+		"path to external schedules")
+	flags.Float64Var(&(config.MinPercSpace),
+		"minPercSpace", 0,
+		"if set, keep at least x% of the snapshots filesystem free")
+	flags.IntVar(&(config.MinGiBSpace),
+		"minGbSpace", 0,
+		"if set, keep at least x GiB of the snapshots filesystem free")
+	flags.StringVar(&(config.Notify),
+		"notify", "",
+		"specify an email address to send reports")
+	flags.StringVar(&(config.MailBackend),
+		"mailBackend", "command",
+		"how to send notifications: \"command\" (the mail command) or \"smtp\"")
+	flags.StringVar(&(config.MailFrom),
+		"mailFrom", "",
+		"sender address of notifications, default is snaprd@<hostname>")
+	flags.StringVar(&(config.SmtpHost),
+		"smtpHost", "localhost",
+		"SMTP server for -mailBackend=smtp")
+	flags.IntVar(&(config.SmtpPort),
+		"smtpPort", 25,
+		"port of the SMTP server")
+	flags.BoolVar(&(config.SmtpStartTLS),
+		"smtpStartTLS", false,
+		"if set, use STARTTLS to encrypt the SMTP connection")
+	flags.StringVar(&(config.SmtpUser),
+		"smtpUser", "",
+		"if set, authenticate to the SMTP server with this user")
+	flags.StringVar(&(config.SmtpPassword),
+		"smtpPassword", "",
+		"password for -smtpUser. Better put it into the -config file")
+	flags.StringVar(&(config.WebhookURL),
+		"webhookURL", "",
+		"if set, post notifications as JSON to this URL")
+	flags.DurationVar(&(config.WebhookTimeout),
+		"webhookTimeout", time.Second*10,
+		"timeout for each webhook request")
+	flags.IntVar(&(config.WebhookRetries),
+		"webhookRetries", 3,
+		"how often to retry a failed webhook request")
+	flags.Float64Var(&(config.OverdueFactor),
+		"overdueFactor", 3,
+		"notify if no snapshot completed within this many times the first interval. Use 0 to disable")
+	flags.StringVar(&(config.Digest),
+		"digest", "",
+		"if set to \"daily\" or \"weekly\", send a summary to the -notify address")
+	flags.StringVar(&(config.MetricsListen),
+		"metricsListen", "",
+		"if set, serve prometheus metrics on this address, e. g. \":9469\"")
+	flags.StringVar(&(config.PreHook),
+		"preHook", "",
+		"shell command to run before rsync")
+	flags.StringVar(&(config.PostHook),
+		"postHook", "",
+		"shell command to run after rsync, also if it failed")
+	flags.StringVar(&(config.PreHookFailure),
+		"preHookFailure", "skip",
+		"what to do if the pre hook fails: \"skip\" this snapshot or \"abort\"")
+	flags.StringVar(&(config.jobsFile),
+		"jobsFile", "",
+		"if set, run the jobs defined in this file, each in its own process")
+	flags.StringVar(&(config.configFile),
+		"config", "",
+		"read settings from this TOML file. Command line flags take precedence")
+	return flags
+}
+
+// setFlags returns the names of all flags that have been set.
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// -r and -repository are the same setting
+	set["r"] = set["r"] || set["repository"]
+	set["repository"] = set["r"]
+	return set
+}
+
+// parseRunArgs parses the command line arguments of the run subcommand,
+// including the settings from a configuration file given with -config.
+func parseRunArgs(args []string) (*Config, *flag.FlagSet, error) {
+	config := new(Config)
+	flags := newRunFlagSet(config)
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	fromFile := make(map[string]bool)
+	if config.configFile != "" {
+		keys, err := applyConfigFile(flags, config.configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, k := range keys {
+			fromFile[k] = true
+		}
+	}
+	if config.SmtpPassword == "" {
+		config.SmtpPassword = inheritedSmtpPassword
+	}
+	if config.WebhookURL == "" {
+		config.WebhookURL = inheritedWebhookURL
+	}
+	switch config.PreHookFailure {
+	case "skip", "abort":
+	default:
+		return nil, nil, fmt.Errorf("invalid value for -preHookFailure: %s", config.PreHookFailure)
+	}
+	policy, err := parseRsyncPolicy(config.RsyncPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.rsyncPolicy = policy
+	debugf("rsync policy: %s", formatRsyncPolicy(config.rsyncPolicy))
+	switch config.MailBackend {
+	case "command", "smtp":
+	default:
+		return nil, nil, fmt.Errorf("invalid value for -mailBackend: %s", config.MailBackend)
+	}
+	switch config.Digest {
+	case "", "daily", "weekly":
+	default:
+		return nil, nil, fmt.Errorf("invalid value for -digest: %s", config.Digest)
+	}
+	if config.Digest != "" && config.Notify == "" && config.jobsFile == "" {
+		return nil, nil, fmt.Errorf("-digest needs a -notify address")
+	}
+	if (config.AlignOffset != 0 || config.AlignTZ != "") && !config.Align && config.jobsFile == "" {
+		return nil, nil, fmt.Errorf("-alignOffset and -alignTZ need -align")
+	}
+	if config.AlignTZ != "" {
+		if _, err := time.LoadLocation(config.AlignTZ); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for -alignTZ: %s", err)
+		}
+	}
+	set := setFlags(flags)
+	flags.VisitAll(func(f *flag.Flag) {
+		from := "default"
+		if fromFile[f.Name] {
+			from = "config file"
+		} else if set[f.Name] {
+			from = "command line"
+		}
+		debugf("setting %s = %s (from %s)", f.Name, f.Value, from)
+	})
+	if config.jobsFile != "" {
+		config.jobArgs = inheritedJobArgs(flags, fromFile)
+	}
+	return config, flags, nil
+}
+
+// applyConfigFile reads settings from a TOML file like this:
+//
+//	origin = "fileserver:/export/projects"
+//	repository = "/snapshots/projects"
+//	schedule = "shortterm"
+//	maxKeep = 4
+//	rsyncOpts = ["--exclude=.cache", "--one-file-system"]
+//
+// The keys are the names of the flags. Flags that have been given on the
+// command line are not changed. Returns the keys that were taken from the file.
+func applyConfigFile(flags *flag.FlagSet, file string) ([]string, error) {
+	var readData map[string]interface{}
+	if _, err := toml.DecodeFile(file, &readData); err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+	set := setFlags(flags)
+	var keys []string
+	for k := range readData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var applied []string
+	for _, k := range keys {
+		if flags.Lookup(k) == nil || k == "config" {
+			return nil, fmt.Errorf("Error in config file %s: unknown setting %s", file, k)
+		}
+		if set[k] {
+			continue
+		}
+		// lists are taken as they are, so elements can contain spaces
+		if o, ok := flags.Lookup(k).Value.(*opts); ok {
+			if list, ok := readData[k].([]interface{}); ok {
+				a := make(opts, 0, len(list))
+				for _, e := range list {
+					s, err := flagValue(e)
+					if err != nil {
+						return nil, fmt.Errorf("Error in config file %s: %s: %v", file, k, err)
+					}
+					a = append(a, s)
+				}
+				*o = a
+				applied = append(applied, k)
+				continue
+			}
+		}
+		v, err := flagValue(readData[k])
+		if err != nil {
+			return nil, fmt.Errorf("Error in config file %s: %s: %v", file, k, err)
+		}
+		if err := flags.Set(k, v); err != nil {
+			return nil, fmt.Errorf("Error in config file %s: %s: %v", file, k, err)
+		}
+		applied = append(applied, k)
+	}
+	return applied, nil
+}
+
 func loadConfig() (*Config, error) {
 	config := new(Config)
 	if len(os.Args) > 1 {
@@ -129,51 +484,8 @@ func loadConfig() (*Config, error) {
 	switch subcmd {
 	case "run":
 		{
-			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
-			flags.StringVar(&(config.RsyncPath),
-				"rsyncPath", "/usr/bin/rsync",
-				"path to rsync binary")
-			flags.Var(&(config.RsyncOpts),
-				"rsyncOpts",
-				"additional options for rsync")
-			flags.StringVar(&(config.Origin),
-				"origin", "/tmp/snaprd_test/",
-				"data source")
-			flags.StringVar(&(config.repository),
-				"repository", defaultRepository,
-				"where to store snapshots")
-			flags.StringVar(&(config.repository),
-				"r", defaultRepository,
-				"(shorthand for -repository)")
-			flags.StringVar(&(config.Schedule),
-				"schedule", "longterm",
-				"one of "+schedules.String())
-			flags.IntVar(&(config.MaxKeep),
-				"maxKeep", 0,
-				"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
-			flags.BoolVar(&(config.NoPurge),
-				"noPurge", false,
-				"if set, obsolete snapshots will not be deleted (minimum space requirements will still be honoured)")
-			flags.BoolVar(&(config.NoWait),
-				"noWait", false,
-				"if set, skip the initial waiting time before the first snapshot")
-			flags.BoolVar(&(config.NoLogDate),
-				"noLogDate", false,
-				"if set, does not print date and time in the log output. Useful if output is redirected to syslog")
-			flags.StringVar(&(config.SchedFile),
-				"schedFile", defaultSchedFileName,
-				"path to external schedules")
-			flags.Float64Var(&(config.MinPercSpace),
-				"minPercSpace", 0,
-				"if set, keep at least x% of the snapshots filesystem free")
-			flags.IntVar(&(config.MinGiBSpace),
-				"minGbSpace", 0,
-				"if set, keep at least x GiB of the snapshots filesystem free")
-			flags.StringVar(&(config.Notify),
-				"notify", "",
-				"specify an email address to send reports")
-
-			if err := flags.Parse(os.Args[2:]); err != nil {
+			config, _, err := parseRunArgs(os.Args[2:])
+			if err != nil {
 				return nil, err
 			}
 			if config.SchedFile != "" {
@@ -182,12 +494,17 @@ func loadConfig() (*Config, error) {
 					return nil, err
 				}
 			}
+			if config.jobsFile != "" {
+				// we are only supervising other snaprd processes and do
+				// not have a repository ourselves
+				return config, nil
+			}
 			if _, ok := schedules[config.Schedule]; ok == false {
 				return nil, fmt.Errorf("no such schedule: %s\n", config.Schedule)
 			}
 			path := filepath.Join(config.repository, dataSubdir)
 			debugf("creating repository: %s", path)
-			err := os.MkdirAll(path, 00755)
+			err = os.MkdirAll(path, 00755)
 			if err != nil {
 				return nil, err
 			}
@@ -221,6 +538,89 @@ func loadConfig() (*Config, error) {
 			flags.BoolVar(&(config.noColor),
 				"noColor", false,
 				"do not colorize list output")
+			flags.StringVar(&(config.listFormat),
+				"format", "text",
+				"output format, one of text,json,csv")
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			switch config.listFormat {
+			case "text", "json", "csv":
+			default:
+				return nil, fmt.Errorf("unknown list format: %s", config.listFormat)
+			}
+			if config.SchedFile != "" {
+				err := schedules.addFromFile(config.SchedFile)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err := config.ReadCache()
+			if err != nil {
+				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
+			}
+			debugf("cached config: %v", config)
+			return config, nil
+		}
+	case "restore":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"repository", defaultRepository,
+				"where snapshots are located")
+			flags.StringVar(&(config.repository),
+				"r", defaultRepository,
+				"(shorthand for -repository)")
+			flags.StringVar(&(config.restoreSnapshot),
+				"snapshot", "latest",
+				"snapshot to restore from: \"latest\", \"N ago\", a start time or a snapshot name")
+			flags.StringVar(&(config.restorePath),
+				"path", "",
+				"path inside the snapshot to restore. Default is the whole snapshot")
+			flags.StringVar(&(config.restoreDest),
+				"dest", "",
+				"where to copy the restored data to")
+			flags.BoolVar(&(config.restoreDryRun),
+				"dryRun", false,
+				"if set, only show what would be copied")
+			flags.BoolVar(&(config.restoreForce),
+				"force", false,
+				"if set, allow overwriting existing data in the destination")
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			err := config.ReadCache()
+			if err != nil {
+				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
+			}
+			debugf("cached config: %v", config)
+			return config, nil
+		}
+	case "prune":
+		{
+			var schedule string
+			var maxKeep int
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"repository", defaultRepository,
+				"where snapshots are located")
+			flags.StringVar(&(config.repository),
+				"r", defaultRepository,
+				"(shorthand for -repository)")
+			flags.StringVar(&schedule,
+				"schedule", "",
+				"one of "+schedules.String()+". Default is the schedule of the repository")
+			flags.IntVar(&maxKeep,
+				"maxKeep", 0,
+				"how many snapshots to keep in highest (oldest) interval. Default is the setting of the repository")
+			flags.StringVar(&(config.SchedFile),
+				"schedFile", defaultSchedFileName,
+				"path to external schedules")
+			flags.BoolVar(&(config.pruneDryRun),
+				"dryRun", false,
+				"if set, only show which snapshots would be marked as obsolete")
 
 			if err := flags.Parse(os.Args[2:]); err != nil {
 				return nil, err
@@ -235,9 +635,141 @@ func loadConfig() (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
 			}
+			set := setFlags(flags)
+			if set["schedule"] {
+				if _, ok := schedules[schedule]; ok == false {
+					return nil, fmt.Errorf("no such schedule: %s\n", schedule)
+				}
+				config.Schedule = schedule
+			}
+			if set["maxKeep"] {
+				config.MaxKeep = maxKeep
+			}
 			debugf("cached config: %v", config)
 			return config, nil
 		}
+	case "pin", "unpin":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"repository", defaultRepository,
+				"where snapshots are located")
+			flags.StringVar(&(config.repository),
+				"r", defaultRepository,
+				"(shorthand for -repository)")
+			flags.Usage = func() {
+				fmt.Fprintf(flags.Output(), "usage: %s %s <options> <snapshot>\n", myName, subcmd)
+				fmt.Fprintf(flags.Output(), "<snapshot> can be \"latest\", \"N ago\", a start time or a snapshot name\n")
+				flags.PrintDefaults()
+			}
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			if flags.NArg() != 1 {
+				flags.Usage()
+				return nil, errors.New("exactly one snapshot must be given")
+			}
+			config.pinSnapshot = flags.Arg(0)
+			return config, nil
+		}
+	case "status":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"repository", defaultRepository,
+				"where snapshots are located")
+			flags.StringVar(&(config.repository),
+				"r", defaultRepository,
+				"(shorthand for -repository)")
+			flags.Float64Var(&(config.statusWarn),
+				"warning", 1.5,
+				"warn if the last complete snapshot is older than this many times the first interval")
+			flags.Float64Var(&(config.statusCrit),
+				"critical", 3,
+				"critical if the last complete snapshot is older than this many times the first interval")
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			err := config.ReadCache()
+			if err != nil {
+				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
+			}
+			return config, nil
+		}
+	case "ctl":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"repository", defaultRepository,
+				"where snapshots are located")
+			flags.StringVar(&(config.repository),
+				"r", defaultRepository,
+				"(shorthand for -repository)")
+			flags.Usage = func() {
+				fmt.Fprintf(flags.Output(), "usage: %s %s <options> <command>\n", myName, subcmd)
+				fmt.Fprintf(flags.Output(), "<command> is one of: %s\n", strings.Join(ctlCommands, ", "))
+				flags.PrintDefaults()
+			}
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			if flags.NArg() != 1 {
+				flags.Usage()
+				return nil, errors.New("exactly one command must be given")
+			}
+			config.ctlCommand = flags.Arg(0)
+			return config, nil
+		}
+	case "simulate":
+		{
+			var duration, initialSize, dailyChange string
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.Schedule),
+				"schedule", "longterm",
+				"one of "+schedules.String())
+			flags.StringVar(&(config.SchedFile),
+				"schedFile", defaultSchedFileName,
+				"path to external schedules")
+			flags.IntVar(&(config.MaxKeep),
+				"maxKeep", 0,
+				"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
+			flags.StringVar(&duration,
+				"duration", "1y",
+				"how long to simulate, e. g. \"2y\" or \"6M\"")
+			flags.StringVar(&initialSize,
+				"initialSize", "0",
+				"size of the origin, e. g. \"500GiB\"")
+			flags.StringVar(&dailyChange,
+				"dailyChange", "0",
+				"amount of data changing each day, e. g. \"5GiB\"")
+
+			if err := flags.Parse(os.Args[2:]); err != nil {
+				return nil, err
+			}
+			if config.SchedFile != "" {
+				err := schedules.addFromFile(config.SchedFile)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if _, ok := schedules[config.Schedule]; ok == false {
+				return nil, fmt.Errorf("no such schedule: %s\n", config.Schedule)
+			}
+			var err error
+			if config.simDuration, err = parseSpan(duration); err != nil {
+				return nil, err
+			}
+			if config.simInitialSize, err = parseSize(initialSize); err != nil {
+				return nil, err
+			}
+			if config.simDailyChange, err = parseSize(dailyChange); err != nil {
+				return nil, err
+			}
+			return config, nil
+		}
 	case "help", "-h", "--help":
 		{
 			usage()
@@ -249,12 +781,28 @@ func loadConfig() (*Config, error) {
 			flags.StringVar(&(config.SchedFile),
 				"schedFile", defaultSchedFileName,
 				"path to external schedules")
+			flags.StringVar(&(config.schedCheck),
+				"check", "",
+				"only validate the schedules in this file and report all errors, including intervals that are not a multiple of the previous one")
+			flags.IntVar(&(config.MaxKeep),
+				"maxKeep", 0,
+				"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
+			flags.StringVar(&(config.schedFormat),
+				"format", "text",
+				"output format, one of text,json")
 
 			if err := flags.Parse(os.Args[2:]); err != nil {
 				return nil, err
 			}
-			if config.SchedFile != "" {
-				schedules.addFromFile(config.SchedFile)
+			switch config.schedFormat {
+			case "text", "json":
+			default:
+				return nil, fmt.Errorf("unknown scheds format: %s", config.schedFormat)
+			}
+			if config.schedCheck == "" && config.SchedFile != "" {
+				if err := schedules.addFromFile(config.SchedFile); err != nil {
+					return nil, err
+				}
 			}
 			return config, nil
 		}
@@ -0,0 +1,135 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRunArgsConfigFile(t *testing.T) {
+	c, _, err := parseRunArgs([]string{"-config=testdata/snaprd.toml", "-maxKeep=7", "-r=/tmp/elsewhere"})
+	if err != nil {
+		t.Fatalf("parseRunArgs() gave error %v", err)
+	}
+	// command line flags win over the config file
+	if c.MaxKeep != 7 {
+		t.Errorf("MaxKeep is %d, wanted 7", c.MaxKeep)
+	}
+	if c.repository != "/tmp/elsewhere" {
+		t.Errorf("repository is %s, wanted /tmp/elsewhere", c.repository)
+	}
+	if c.Origin != "fileserver:/export/projects" || c.Schedule != "shortterm" ||
+		c.MinPercSpace != 2.5 || !c.NoPurge {
+		t.Errorf("settings from config file not applied: %+v", c)
+	}
+	if wanted := (opts{"--exclude=.cache", "--one-file-system"}); !reflect.DeepEqual(c.RsyncOpts, wanted) {
+		t.Errorf("RsyncOpts is %v, wanted %v", c.RsyncOpts, wanted)
+	}
+	// defaults stay untouched
+	if c.RsyncPath != "/usr/bin/rsync" {
+		t.Errorf("RsyncPath is %s, wanted the default", c.RsyncPath)
+	}
+}
+
+func TestParseRunArgsConfigFileBad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	tests := []string{
+		`noSuchSetting = 1`,
+		`maxKeep = "many"`,
+		`config = "/etc/other.toml"`,
+		`origin = `,
+	}
+	for _, s := range tests {
+		file := filepath.Join(dir, "config.toml")
+		ioutil.WriteFile(file, []byte(s), 0644)
+		if _, _, err := parseRunArgs([]string{"-config=" + file}); err == nil {
+			t.Errorf("parseRunArgs() did not fail for config file %q", s)
+		}
+	}
+}
+
+func TestParseRunArgsConfigFileListWithSpaces(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.toml")
+	ioutil.WriteFile(file, []byte(`rsyncOpts = ["--exclude=My Files", "--one-file-system"]`), 0644)
+	c, _, err := parseRunArgs([]string{"-config=" + file, "-jobsFile=testdata/snaprd.jobs"})
+	if err != nil {
+		t.Fatalf("parseRunArgs() gave error %v", err)
+	}
+	wanted := opts{"--exclude=My Files", "--one-file-system"}
+	if !reflect.DeepEqual(c.RsyncOpts, wanted) {
+		t.Errorf("RsyncOpts is %q, wanted %q", c.RsyncOpts, wanted)
+	}
+	// the jobs inherit the list with the elements kept apart
+	if len(c.jobArgs) != 1 {
+		t.Fatalf("jobArgs is %q, wanted only -rsyncOpts", c.jobArgs)
+	}
+	child := new(Config)
+	if err := newRunFlagSet(child).Parse(c.jobArgs); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(child.RsyncOpts, wanted) {
+		t.Errorf("job got RsyncOpts %q, wanted %q", child.RsyncOpts, wanted)
+	}
+}
+
+func TestOptsSet(t *testing.T) {
+	tests := map[string]opts{
+		"--exclude=.cache --one-file-system": {"--exclude=.cache", "--one-file-system"},
+		`["--exclude=My Files", "-x"]`:       {"--exclude=My Files", "-x"},
+	}
+	for s, wanted := range tests {
+		var o opts
+		if err := o.Set(s); err != nil || !reflect.DeepEqual(o, wanted) {
+			t.Errorf("Set(%s) got %q, %v, wanted %q", s, o, err, wanted)
+		}
+	}
+}
+
+func TestReadCacheInvalidSchedules(t *testing.T) {
+	saved := schedules
+	defer func() { schedules = saved }()
+	schedules = scheduleList{}
+	for k, v := range saved {
+		schedules[k] = v
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "."+myName+".settings")
+	// the schedule of the repository is valid, others in the file are not
+	ioutil.WriteFile(cache, []byte(`{"SchedFile": "testdata/broken.schedules", "Schedule": "good"}`), 0644)
+	c := &Config{repository: dir}
+	if err := c.ReadCache(); err != nil {
+		t.Errorf("ReadCache() failed because of other schedules: %v", err)
+	}
+	if _, ok := schedules["typo"]; ok {
+		t.Error("invalid schedule has been added")
+	}
+	ioutil.WriteFile(cache, []byte(`{"SchedFile": "testdata/broken.schedules", "Schedule": "typo"}`), 0644)
+	if err := c.ReadCache(); err == nil || !strings.Contains(err.Error(), "unknown unit") {
+		t.Errorf("ReadCache() gave %v for an invalid schedule, wanted the reason", err)
+	}
+}
+
+func TestWriteCacheSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	c := &Config{repository: dir, SmtpPassword: "s3cret", WebhookURL: "http://hook/t0ken"}
+	if err := c.WriteCache(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "."+myName+".settings"))
+	if strings.Contains(string(b), "s3cret") || strings.Contains(string(b), "t0ken") {
+		t.Errorf("secrets written to the settings cache: %s", b)
+	}
+}
@@ -0,0 +1,360 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Control socket of the run subcommand and the ctl subcommand as its client
+// The protocol is one JSON object per line: the client sends a ctlRequest, the
+// daemon answers with a ctlReply and closes the connection.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ctlWait is how long the daemon waits for a command that has to run in the
+// create loop before it replies that the command has been queued.
+const ctlWait = time.Second * 5
+
+// ctlCommands lists the commands understood by the daemon.
+var ctlCommands = []string{"status", "snapshot-now", "pause", "resume", "prune-now", "reload", "stop"}
+
+type ctlRequest struct {
+	Command string `json:"command"`
+}
+
+type ctlReply struct {
+	OK      bool       `json:"ok"`
+	Message string     `json:"message,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Status  *ctlStatus `json:"status,omitempty"`
+}
+
+// ctlStatus describes the state of a running daemon.
+type ctlStatus struct {
+	Pid          int       `json:"pid"`
+	Started      time.Time `json:"started"`
+	Repository   string    `json:"repository"`
+	Origin       string    `json:"origin"`
+	Schedule     string    `json:"schedule"`
+	Paused       bool      `json:"paused"`
+	Creating     string    `json:"creating,omitempty"`
+	LastComplete string    `json:"lastComplete,omitempty"`
+}
+
+// daemon holds the state of subcmdRun that can be changed from the outside.
+type daemon struct {
+	mu       sync.Mutex
+	started  time.Time
+	paused   bool
+	creating bool
+	// created is closed when the snapshot being created is finished
+	created chan struct{}
+	// changed is notified when the create loop has to look at paused again
+	changed chan struct{}
+	// force makes the lastGoodTicker skip the waiting time
+	force chan struct{}
+	// safe takes functions that have to be run by the create loop, between
+	// two snapshots
+	safe chan func()
+	// reloaded holds a channel for each goroutine that has to know when
+	// new settings have been applied, see onReload
+	reloaded []chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDaemon() *daemon {
+	return &daemon{
+		started: time.Now(),
+		changed: make(chan struct{}, 1),
+		force:   make(chan struct{}, 1),
+		safe:    make(chan func()),
+		stop:    make(chan struct{}),
+	}
+}
+
+// onReload returns a channel that is notified whenever new settings have been
+// applied.
+func (d *daemon) onReload() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reloaded = append(d.reloaded, c)
+	return c
+}
+
+// notifyReload notifies all channels returned by onReload, without waiting
+// for their readers.
+func (d *daemon) notifyReload() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.reloaded {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *daemon) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+func (d *daemon) setPaused(paused bool) {
+	d.mu.Lock()
+	d.paused = paused
+	d.mu.Unlock()
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// setCreating records if a snapshot is being created.
+func (d *daemon) setCreating(creating bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if creating {
+		d.created = make(chan struct{})
+	} else if d.created != nil {
+		close(d.created)
+		d.created = nil
+	}
+	d.creating = creating
+}
+
+func (d *daemon) isCreating() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.creating
+}
+
+// waitCreated waits until the snapshot that is being created, if any, is
+// finished, but at most for timeout.
+func (d *daemon) waitCreated(timeout time.Duration) {
+	d.mu.Lock()
+	created := d.created
+	d.mu.Unlock()
+	if created == nil {
+		return
+	}
+	select {
+	case <-created:
+	case <-time.After(timeout):
+	}
+}
+
+func (d *daemon) status() *ctlStatus {
+	config := currentConfig()
+	d.mu.Lock()
+	st := &ctlStatus{
+		Pid:        os.Getpid(),
+		Started:    d.started,
+		Repository: config.repository,
+		Origin:     config.Origin,
+		Schedule:   config.Schedule,
+		Paused:     d.paused,
+	}
+	creating := d.creating
+	d.mu.Unlock()
+	if creating {
+		if sn := lastReusableFromDisk(new(realClock)); sn != nil {
+			st.Creating = sn.Name()
+		}
+	}
+	snapshots, err := findSnapshots(new(realClock))
+	if err != nil {
+		log.Println(err)
+	}
+	if sn := snapshots.state(stateComplete, none).lastGood(); sn != nil {
+		st.LastComplete = sn.Name()
+	}
+	return st
+}
+
+// runSafely runs f in the create loop. If that does not happen within
+// ctlWait, because a snapshot is being created, f stays queued and false is
+// returned.
+func (d *daemon) runSafely(f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		d.safe <- func() {
+			f()
+			close(done)
+		}
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(ctlWait):
+		return false
+	case <-d.stop:
+		return false
+	}
+}
+
+// handle executes one command and returns the reply.
+func (d *daemon) handle(req ctlRequest, obsoleteQueue chan *snapshot, cl clock) ctlReply {
+	switch req.Command {
+	case "status":
+		return ctlReply{OK: true, Status: d.status()}
+	case "snapshot-now":
+		if d.isPaused() {
+			return ctlReply{Error: "scheduling is paused, use resume first"}
+		}
+		if d.isCreating() {
+			return ctlReply{OK: true, Message: "a snapshot is already running"}
+		}
+		select {
+		case d.force <- struct{}{}:
+			return ctlReply{OK: true, Message: "snapshot requested"}
+		default:
+			return ctlReply{OK: true, Message: "a snapshot has already been requested"}
+		}
+	case "pause":
+		d.setPaused(true)
+		log.Println("scheduling paused by control socket")
+		return ctlReply{OK: true, Message: "scheduling paused"}
+	case "resume":
+		d.setPaused(false)
+		log.Println("scheduling resumed by control socket")
+		return ctlReply{OK: true, Message: "scheduling resumed"}
+	case "prune-now":
+		if d.runSafely(func() { prune(obsoleteQueue, cl) }) {
+			return ctlReply{OK: true, Message: "pruned"}
+		}
+		return ctlReply{OK: true, Message: "prune queued, it will run after the current snapshot"}
+	case "reload":
+		c, scheds, err := reloadRunConfig()
+		if err != nil {
+			return ctlReply{Error: err.Error()}
+		}
+		if d.runSafely(func() { d.applyRunConfig(c, scheds) }) {
+			return ctlReply{OK: true, Message: "settings reloaded"}
+		}
+		return ctlReply{OK: true, Message: "reload queued, it will be done after the current snapshot"}
+	case "stop":
+		d.stopOnce.Do(func() { close(d.stop) })
+		return ctlReply{OK: true, Message: "stopping after the current snapshot"}
+	}
+	return ctlReply{Error: fmt.Sprintf("unknown command: %s", req.Command)}
+}
+
+// controlSocket returns the path of the control socket of the repository.
+func controlSocket(repository string) string {
+	return filepath.Join(repository, "."+myName+".sock")
+}
+
+// listenControl creates the control socket at path. The socket is created in
+// a private directory and moved into place only after its permissions have
+// been restricted, so other users can not connect at any time.
+func listenControl(path string) (*net.UnixListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+myName+".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed by its new name, see subcmdRun
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		// a socket left behind by a previous run is replaced, the
+		// repository lock makes sure that it is not in use
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveControl accepts commands on the control socket. It does not return
+// unless there is an error.
+func serveControl(d *daemon, obsoleteQueue chan *snapshot, cl clock) {
+	config := currentConfig()
+	path := controlSocket(config.repository)
+	l, err := listenControl(path)
+	if err != nil {
+		log.Println("could not create control socket:", err)
+		return
+	}
+	defer l.Close()
+	debugf("listening on control socket %s", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println("control socket failed:", err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var req ctlRequest
+			var reply ctlReply
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			if err == nil {
+				err = json.Unmarshal(line, &req)
+			}
+			if err != nil {
+				reply = ctlReply{Error: fmt.Sprintf("malformed request: %s", err)}
+			} else {
+				debugf("control socket command: %s", req.Command)
+				reply = d.handle(req, obsoleteQueue, cl)
+			}
+			json.NewEncoder(conn).Encode(reply)
+		}(conn)
+	}
+}
+
+// sendControl sends cmd to the daemon running in repository and returns the
+// reply.
+func sendControl(repository, cmd string) (*ctlReply, error) {
+	conn, err := net.Dial("unix", controlSocket(repository))
+	if err != nil {
+		return nil, fmt.Errorf("no snaprd running for %s: %s", repository, err)
+	}
+	defer conn.Close()
+	err = json.NewEncoder(conn).Encode(ctlRequest{Command: cmd})
+	if err != nil {
+		return nil, err
+	}
+	reply := new(ctlReply)
+	err = json.NewDecoder(conn).Decode(reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// subcmdCtl sends a command to the running daemon and prints the reply.
+func subcmdCtl() error {
+	reply, err := sendControl(config.repository, config.ctlCommand)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(reply, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if !reply.OK {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
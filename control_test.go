@@ -0,0 +1,89 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	cl := newSkewClock(startAt)
+	// late enough for prune to find something to do
+	cl.forward(schedules[config.Schedule][0] * 11)
+	d := newDaemon()
+	q := make(chan *snapshot, 100)
+	go serveControl(d, q, cl)
+	// stand-in for the create loop
+	go func() {
+		for f := range d.safe {
+			f()
+		}
+	}()
+
+	send := func(cmd string) *ctlReply {
+		t.Helper()
+		var reply *ctlReply
+		var err error
+		// the socket may not be there yet
+		for i := 0; i < 100; i++ {
+			if reply, err = sendControl(config.repository, cmd); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		if err != nil {
+			t.Fatalf("sendControl(%s) failed: %v", cmd, err)
+		}
+		return reply
+	}
+
+	reply := send("status")
+	if !reply.OK || reply.Status == nil || reply.Status.Pid != os.Getpid() ||
+		reply.Status.LastComplete != "1400337721-1400337722-complete" {
+		t.Errorf("status reply %+v does not describe the daemon", reply)
+	}
+	if fi, err := os.Stat(controlSocket(config.repository)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("control socket is not private: %v %v", fi, err)
+	}
+	if reply := send("pause"); !reply.OK || !d.isPaused() {
+		t.Errorf("pause reply %+v, paused is %v", reply, d.isPaused())
+	}
+	if reply := send("snapshot-now"); reply.OK {
+		t.Errorf("snapshot-now succeeded while paused: %+v", reply)
+	}
+	if reply := send("resume"); !reply.OK || d.isPaused() {
+		t.Errorf("resume reply %+v, paused is %v", reply, d.isPaused())
+	}
+	if reply := send("snapshot-now"); !reply.OK || len(d.force) != 1 {
+		t.Errorf("snapshot-now reply %+v, %d forced", reply, len(d.force))
+	}
+	if reply := send("snapshot-now"); !reply.OK || reply.Message != "a snapshot has already been requested" {
+		t.Errorf("second snapshot-now reply %+v", reply)
+	}
+	<-d.force
+	d.setCreating(true)
+	if reply := send("snapshot-now"); !reply.OK || reply.Message != "a snapshot is already running" || len(d.force) != 0 {
+		t.Errorf("snapshot-now reply %+v while creating, %d forced", reply, len(d.force))
+	}
+	d.setCreating(false)
+	if reply := send("prune-now"); !reply.OK || reply.Message != "pruned" || len(q) == 0 {
+		t.Errorf("prune-now reply %+v, %d snapshots obsoleted", reply, len(q))
+	}
+	if reply := send("bogus"); reply.OK || reply.Error == "" {
+		t.Errorf("unknown command did not fail: %+v", reply)
+	}
+	if reply := send("stop"); !reply.OK {
+		t.Errorf("stop reply %+v", reply)
+	}
+	select {
+	case <-d.stop:
+	default:
+		t.Errorf("stop did not close the stop channel")
+	}
+}
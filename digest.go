@@ -0,0 +1,117 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Periodic summary of the repository, sent by mail
+// Without it, no notification could either mean that everything is fine or
+// that snaprd is not running at all.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// nextDigest returns the time the next digest is due after t: midnight for
+// "daily", Monday midnight for "weekly".
+func nextDigest(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	next := time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	if period == "weekly" {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+// digestText summarizes what happened between the counters prev and cur,
+// which were taken at since and now, and the current contents of the
+// repository.
+func digestText(prev, cur metricsCounters, since time.Time, cl clock) string {
+	config, schedules := currentSettings()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Repository: %s\n", config.repository)
+	fmt.Fprintf(&b, "Origin: %s\n", config.Origin)
+	fmt.Fprintf(&b, "Period: %s to %s\n\n",
+		since.Format("2006-01-02 15:04:05"), cl.Now().Format("2006-01-02 15:04:05"))
+
+	created := cur.snapshotsCreated - prev.snapshotsCreated
+	fmt.Fprintf(&b, "Snapshots created: %d\n", created)
+	if created > 0 {
+		avg := (cur.totalDuration - prev.totalDuration) / time.Duration(created)
+		fmt.Fprintf(&b, "Average duration: %s\n", avg.Truncate(time.Second))
+	}
+	fmt.Fprintf(&b, "Snapshots purged: %d\n", cur.purgeCount-prev.purgeCount)
+	var codes []int
+	for code := range cur.rsyncExitCodes {
+		if code != 0 && cur.rsyncExitCodes[code] > prev.rsyncExitCodes[code] {
+			codes = append(codes, code)
+		}
+	}
+	sort.Ints(codes)
+	if len(codes) == 0 {
+		fmt.Fprintf(&b, "rsync warnings: none\n")
+	} else {
+		fmt.Fprintf(&b, "rsync warnings:\n")
+		for _, code := range codes {
+			fmt.Fprintf(&b, "    %dx exit code %d (%s)\n",
+				cur.rsyncExitCodes[code]-prev.rsyncExitCodes[code], code, rsyncExitDescription(code))
+		}
+	}
+	sizeBytes, freeBytes, err := freeSpace(config.repository)
+	if err != nil {
+		fmt.Fprintf(&b, "Free space: unknown (%s)\n", err)
+	} else {
+		fmt.Fprintf(&b, "Free space: %s of %s (%.1f%%)\n", humanBytes(int64(freeBytes)),
+			humanBytes(int64(sizeBytes)), 100*float64(freeBytes)/float64(sizeBytes))
+	}
+
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		log.Println(err)
+	}
+	fmt.Fprintf(&b, "\nSnapshots per interval (schedule %s):\n", config.Schedule)
+	for i, iv := range listIntervals(snapshots.state(stateComplete, none), schedules[config.Schedule], config.MaxKeep, cl) {
+		spacing := time.Duration(iv.Spacing) * time.Second
+		from := time.Duration(iv.From) * time.Second
+		// the oldest interval comes first
+		if i > 0 {
+			fmt.Fprintf(&b, "    every %s from %s ago: %d/%d\n", spacing, from, len(iv.Snapshots), iv.Goal)
+		} else if iv.Goal != 0 {
+			fmt.Fprintf(&b, "    every %s from past: %d/%d\n", spacing, len(iv.Snapshots), iv.Goal)
+		} else {
+			fmt.Fprintf(&b, "    every %s from past: %d/∞\n", spacing, len(iv.Snapshots))
+		}
+	}
+	return b.String()
+}
+
+// runDigest sends a digest mail once per -digest period, while it is set.
+// When the settings are reloaded, the next digest is computed again. It never
+// returns.
+func runDigest(cl clock, reload <-chan struct{}) {
+	since := cl.Now()
+	prev := metrics.counters()
+	for {
+		config := currentConfig()
+		if config.Digest == "" {
+			<-reload
+			continue
+		}
+		next := nextDigest(cl.Now(), config.Digest)
+		debugf("next %s digest at %s", config.Digest, next)
+		select {
+		case <-time.After(next.Sub(cl.Now())):
+		case <-reload:
+			continue
+		}
+		cur := metrics.counters()
+		subject := fmt.Sprintf("snaprd %s digest (origin: %s)", config.Digest, config.Origin)
+		SendMail(config.Notify, subject, digestText(prev, cur, since, cl))
+		prev = cur
+		since = cl.Now()
+	}
+}
@@ -0,0 +1,55 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextDigest(t *testing.T) {
+	// Saturday
+	now := time.Date(2014, 5, 17, 16, 38, 51, 0, time.Local)
+	if got, wanted := nextDigest(now, "daily"), time.Date(2014, 5, 18, 0, 0, 0, 0, time.Local); !got.Equal(wanted) {
+		t.Errorf("nextDigest(daily) = %s, wanted %s", got, wanted)
+	}
+	if got, wanted := nextDigest(now, "weekly"), time.Date(2014, 5, 19, 0, 0, 0, 0, time.Local); !got.Equal(wanted) {
+		t.Errorf("nextDigest(weekly) = %s, wanted %s", got, wanted)
+	}
+	// on Monday midnight, the next weekly digest is one week later
+	monday := time.Date(2014, 5, 19, 0, 0, 0, 0, time.Local)
+	if got, wanted := nextDigest(monday, "weekly"), time.Date(2014, 5, 26, 0, 0, 0, 0, time.Local); !got.Equal(wanted) {
+		t.Errorf("nextDigest(weekly) = %s, wanted %s", got, wanted)
+	}
+}
+
+func TestDigestText(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	cl := newVirtualClock(startAt)
+	m := newMetricsRegistry()
+	prev := m.counters()
+	m.snapshotCreated(newSnapshot(time.Unix(1400337700, 0), time.Unix(1400337710, 0), stateComplete))
+	m.snapshotCreated(newSnapshot(time.Unix(1400337711, 0), time.Unix(1400337741, 0), stateComplete))
+	m.rsyncExited(0)
+	m.rsyncExited(23)
+	m.purged(time.Second)
+	got := digestText(prev, m.counters(), time.Unix(1400337000, 0), cl)
+	for _, want := range []string{
+		"Snapshots created: 2\n",
+		"Average duration: 20s\n",
+		"Snapshots purged: 1\n",
+		"    1x exit code 23 (Partial transfer due to error)\n",
+		"Free space: ",
+		"    every 5s from 20s ago: 4/4\n",
+		"    every 1m20s from past: 1/2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("digest does not contain %q:\n%s", want, got)
+		}
+	}
+}
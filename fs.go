@@ -17,6 +17,19 @@ import (
 // GiB is exactly one gibibyte (2^30)
 const GiB = 1024 * 1024 * 1024
 
+// freeSpace returns the size and the free space in bytes of the filesystem
+// baseDir is located on.
+func freeSpace(baseDir string) (sizeBytes, freeBytes uint64, err error) {
+	var stats syscall.Statfs_t
+	err = syscall.Statfs(baseDir, &stats)
+	if err != nil {
+		return
+	}
+	sizeBytes = uint64(stats.Bsize) * stats.Blocks
+	freeBytes = uint64(stats.Bsize) * stats.Bfree
+	return
+}
+
 // checkFreeSpace verifies the space constraints specified by the user. Return
 // true if all the constraints are satisfied, or in case something unusual
 // happens.
@@ -26,9 +39,8 @@ func checkFreeSpace(baseDir string, minPerc float64, minGiB int) bool {
 		return true
 	}
 
-	var stats syscall.Statfs_t
 	debugf("Trying to check free space in %s", baseDir)
-	err := syscall.Statfs(baseDir, &stats)
+	sizeBytes, freeBytes, err := freeSpace(baseDir)
 	if err != nil {
 		log.Println("could not check free space:", err)
 		// We cannot return false if there is an error, otherwise we risk
@@ -36,9 +48,6 @@ func checkFreeSpace(baseDir string, minPerc float64, minGiB int) bool {
 		return true
 	}
 
-	sizeBytes := uint64(stats.Bsize) * stats.Blocks
-	freeBytes := uint64(stats.Bsize) * stats.Bfree
-
 	debugf("We have %f GiB, and %f GiB of them are free.", float64(sizeBytes)/GiB, float64(freeBytes)/GiB)
 
 	// The actual check... we fail it we are below either the absolute or the
@@ -54,6 +63,7 @@ func checkFreeSpace(baseDir string, minPerc float64, minGiB int) bool {
 // updateSymlinks creates user-friendly symlinks to all complete snapshots. It
 // also removes symlinks to snapshots that have been purged.
 func updateSymlinks() {
+	config := currentConfig()
 	entries, err := ioutil.ReadDir(config.repository)
 	if err != nil {
 		log.Println("could not read repository directory", config.repository)
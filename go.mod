@@ -2,4 +2,7 @@ module github.com/sstark/snaprd
 
 go 1.12
 
-require github.com/daviddengcn/go-colortext v1.0.0
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/daviddengcn/go-colortext v1.0.0
+)
@@ -0,0 +1,105 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// User defined commands that run before and after rsync
+// They can be used to quiesce databases or freeze filesystems for the time of
+// the transfer, and to report the results afterwards.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// skipError is returned by createSnapshot if no snapshot has been made in this
+// cycle, but snaprd should go on and try again later.
+type skipError struct {
+	reason string
+}
+
+func (e skipError) Error() string {
+	return "snapshot skipped: " + e.reason
+}
+
+// hookEnv returns the environment variables describing the snapshot for the
+// hook commands. rsyncExit is the exit code of rsync, or -1 if rsync has not
+// run (yet).
+func hookEnv(sn, base *snapshot, rsyncExit int) []string {
+	env := []string{
+		"SNAPRD_SNAPSHOT_NAME=" + sn.Name(),
+		"SNAPRD_SNAPSHOT_PATH=" + sn.FullName(),
+		"SNAPRD_ORIGIN=" + config.Origin,
+		"SNAPRD_REPOSITORY=" + config.repository,
+	}
+	if base != nil {
+		env = append(env, "SNAPRD_BASE="+base.FullName())
+	} else {
+		env = append(env, "SNAPRD_BASE=")
+	}
+	if rsyncExit >= 0 {
+		env = append(env, "SNAPRD_RSYNC_EXIT="+strconv.Itoa(rsyncExit))
+	} else {
+		env = append(env, "SNAPRD_RSYNC_EXIT=")
+	}
+	return env
+}
+
+// runHook runs command with /bin/sh and waits for it to finish. The output of
+// the command is logged, prefixed by name.
+func runHook(name, command string, env []string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	log.Printf("run %s: %s", name, command)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	in := bufio.NewScanner(out)
+	for in.Scan() {
+		log.Printf("(%s) %s", name, in.Text())
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", name, err)
+	}
+	return nil
+}
+
+// runPreHook runs the pre hook, if there is one. If it fails, the error
+// returned depends on -preHookFailure: a skipError, so the snapshot will be
+// tried again in the next cycle, or a plain error to stop snaprd.
+func runPreHook(sn, base *snapshot) error {
+	if config.PreHook == "" {
+		return nil
+	}
+	err := runHook("preHook", config.PreHook, hookEnv(sn, base, -1))
+	if err == nil {
+		return nil
+	}
+	log.Println(err)
+	if config.PreHookFailure == "skip" {
+		return skipError{err.Error()}
+	}
+	return err
+}
+
+// runPostHook runs the post hook, if there is one. Errors are only logged,
+// since the snapshot has been made already.
+func runPostHook(sn, base *snapshot, rsyncExit int) {
+	if config.PostHook == "" {
+		return
+	}
+	err := runHook("postHook", config.PostHook, hookEnv(sn, base, rsyncExit))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,95 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookEnv(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	config.Origin = "fileserver:/export/projects"
+	sn := newSnapshot(time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateComplete)
+	base := newSnapshot(time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateComplete)
+	got := hookEnv(sn, base, 24)
+	wanted := []string{
+		"SNAPRD_SNAPSHOT_NAME=1400337721-1400337722-complete",
+		"SNAPRD_SNAPSHOT_PATH=" + filepath.Join(config.repository, dataSubdir, "1400337721-1400337722-complete"),
+		"SNAPRD_ORIGIN=fileserver:/export/projects",
+		"SNAPRD_REPOSITORY=" + config.repository,
+		"SNAPRD_BASE=" + filepath.Join(config.repository, dataSubdir, "1400337711-1400337712-complete"),
+		"SNAPRD_RSYNC_EXIT=24",
+	}
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("hookEnv() = %v, wanted %v", got, wanted)
+	}
+	got = hookEnv(sn, nil, -1)
+	if got[4] != "SNAPRD_BASE=" || got[5] != "SNAPRD_RSYNC_EXIT=" {
+		t.Errorf("hookEnv() without base and exit code = %v", got)
+	}
+}
+
+func TestPreHookFailure(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	sn := newSnapshot(time.Unix(1400337721, 0), time.Time{}, stateIncomplete)
+	config.PreHook = "exit 3"
+	config.PreHookFailure = "skip"
+	err := runPreHook(sn, nil)
+	if _, ok := err.(skipError); !ok {
+		t.Errorf("runPreHook() with -preHookFailure=skip returned %v, wanted a skipError", err)
+	}
+	config.PreHookFailure = "abort"
+	err = runPreHook(sn, nil)
+	if _, ok := err.(skipError); ok || err == nil {
+		t.Errorf("runPreHook() with -preHookFailure=abort returned %v, wanted a plain error", err)
+	}
+	config.PreHook = "true"
+	if err := runPreHook(sn, nil); err != nil {
+		t.Errorf("runPreHook() returned %v, but it should have succeeded", err)
+	}
+}
+
+func TestCreateSnapshotHooks(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	// a stand-in for rsync that only creates the target directory
+	rsync := filepath.Join(config.repository, "rsync")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nfor last; do :; done\nmkdir -p \"$last\"\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	out := filepath.Join(config.repository, "hooks.out")
+	config.PreHook = "echo pre $SNAPRD_SNAPSHOT_NAME >> " + out
+	config.PostHook = "echo post $SNAPRD_RSYNC_EXIT $SNAPRD_SNAPSHOT_NAME >> " + out
+	config.PreHookFailure = "skip"
+	sn, err := createSnapshot(nil)
+	if err != nil {
+		t.Fatalf("createSnapshot() returned an error, but it shouldn't: %v", err)
+	}
+	b, _ := ioutil.ReadFile(out)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "pre ") || !strings.HasSuffix(lines[0], "-incomplete") ||
+		lines[1] != "post 0 "+sn.Name() {
+		t.Errorf("hooks wrote %q, wanted pre hook with incomplete and post hook with complete snapshot", lines)
+	}
+
+	// a failing pre hook skips the snapshot and rsync is not run
+	os.Remove(out)
+	config.PreHook = "exit 1"
+	_, err = createSnapshot(sn)
+	if _, ok := err.(skipError); !ok {
+		t.Errorf("createSnapshot() returned %v, wanted a skipError", err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("post hook ran, but the pre hook failed")
+	}
+}
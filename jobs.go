@@ -0,0 +1,369 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Supervision of several snapshot jobs from one snaprd instance
+// Every job runs in its own "snaprd run" child process, so repositories,
+// locks and settings caches stay separated exactly like with single
+// instances.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// jobArgsExcluded are flags of the supervising process that are not passed
+// on to the jobs.
+var jobArgsExcluded = map[string]bool{
+	"config":        true,
+	"jobsFile":      true,
+	"metricsListen": true,
+	"origin":        true,
+	"repository":    true,
+	"r":             true,
+	// passed in the environment, see jobEnv
+	"smtpPassword": true,
+	"webhookURL":   true,
+}
+
+// jobEnv maps the flags that are secret to the environment variables that are
+// used to pass them to the jobs, so they do not show up on the command lines.
+var jobEnv = map[string]string{
+	"smtpPassword": smtpPasswordEnv,
+	"webhookURL":   webhookURLEnv,
+}
+
+// jobKeysRejected are flags that can not be set for a job, because the job
+// would supervise jobs itself or read its settings from elsewhere.
+var jobKeysRejected = map[string]bool{
+	"config":   true,
+	"jobsFile": true,
+}
+
+// A failed job is started again after jobRestartWait. The wait doubles with
+// every failure in a row, up to jobRestartMaxWait.
+var (
+	jobRestartWait    = time.Second * 10
+	jobRestartMaxWait = time.Hour
+)
+
+// flagArg returns a command line argument setting the flag name to the
+// current value of v. Lists are passed as JSON lists, so their elements stay
+// separated.
+func flagArg(name string, v flag.Value) string {
+	if o, ok := v.(*opts); ok {
+		b, _ := json.Marshal([]string(*o))
+		return "-" + name + "=" + string(b)
+	}
+	return "-" + name + "=" + v.String()
+}
+
+// inheritedJobArgs returns the flags that have been set for the supervising
+// process, on the command line or in the config file given by fromFile. They
+// are used as defaults for all jobs.
+func inheritedJobArgs(flags *flag.FlagSet, fromFile map[string]bool) []string {
+	set := setFlags(flags)
+	var args []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if (set[f.Name] || fromFile[f.Name]) && !jobArgsExcluded[f.Name] {
+			args = append(args, flagArg(f.Name, f.Value))
+		}
+	})
+	return args
+}
+
+// flagValue converts a value read from a JSON file into a string that can be
+// given to flag.Value.Set(). Lists are encoded as JSON lists, which
+// -rsyncOpts takes without splitting the elements at spaces.
+func flagValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case []interface{}:
+		a := make([]string, 0, len(t))
+		for _, e := range t {
+			s, err := flagValue(e)
+			if err != nil {
+				return "", err
+			}
+			a = append(a, s)
+		}
+		b, err := json.Marshal(a)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("unsupported value: %v", v)
+}
+
+type job struct {
+	name    string
+	args    []string
+	env     []string
+	cmd     *exec.Cmd
+	running bool
+	status  string
+	started time.Time
+	// wait is the time before the last restart, restarting is true while
+	// the next one is pending
+	wait       time.Duration
+	restarting bool
+}
+
+type jobExit struct {
+	j   *job
+	err error
+}
+
+// readJobsFile reads job definitions from a JSON file like this:
+//
+//	{
+//	  "projects": {
+//	    "origin": "fileserver:/export/projects",
+//	    "repository": "/snapshots/projects"
+//	  },
+//	  "home": {
+//	    "origin": "fileserver:/export/home",
+//	    "repository": "/snapshots/home",
+//	    "schedule": "shortterm",
+//	    "rsyncOpts": ["--exclude=.cache", "--one-file-system"]
+//	  }
+//	}
+//
+// The keys are the flags of the run subcommand. The arguments in inherited are
+// used for all jobs, unless the job sets them itself.
+func readJobsFile(file string, inherited []string) ([]*job, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening jobs file: %v", err)
+	}
+	var readData map[string]map[string]interface{}
+	err = json.Unmarshal(b, &readData)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing jobs file: %v", err)
+	}
+	var names []string
+	for name := range readData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	jobs := make([]*job, 0, len(names))
+	repositories := make(map[string]string)
+	for _, name := range names {
+		j := &job{name: name, status: "not started"}
+		j.args = append(j.args, "run")
+		j.args = append(j.args, inherited...)
+		var keys []string
+		for k := range readData[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if jobKeysRejected[k] {
+				return nil, fmt.Errorf("job %s: %s can not be set for a job", name, k)
+			}
+			v, err := flagValue(readData[name][k])
+			if err != nil {
+				return nil, fmt.Errorf("job %s: %s: %v", name, k, err)
+			}
+			if env, ok := jobEnv[k]; ok {
+				// keep it off the command line
+				j.env = append(j.env, env+"="+v)
+				continue
+			}
+			j.args = append(j.args, "-"+k+"="+v)
+		}
+		// the supervisor adds the date to each line already
+		j.args = append(j.args, "-noLogDate")
+		// check the job settings like the job process would
+		c := new(Config)
+		flags := newRunFlagSet(c)
+		flags.SetOutput(ioutil.Discard)
+		if err := flags.Parse(j.args[1:]); err != nil {
+			return nil, fmt.Errorf("job %s: %v", name, err)
+		}
+		set := setFlags(flags)
+		if !set["origin"] || !set["repository"] {
+			return nil, fmt.Errorf("job %s: origin and repository must be given", name)
+		}
+		if other, ok := repositories[c.repository]; ok {
+			return nil, fmt.Errorf("job %s: repository %s is already used by job %s", name, c.repository, other)
+		}
+		repositories[c.repository] = name
+		jobs = append(jobs, j)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs defined in %s", file)
+	}
+	return jobs, nil
+}
+
+// start runs the job in a child process. All output of the child is logged
+// with the job name as prefix. When the child exits, the result is sent to
+// exited.
+func (j *job) start(exe string, exited chan jobExit) error {
+	j.cmd = exec.Command(exe, j.args...)
+	j.cmd.Env = os.Environ()
+	if config.SmtpPassword != "" {
+		j.cmd.Env = append(j.cmd.Env, smtpPasswordEnv+"="+config.SmtpPassword)
+	}
+	if config.WebhookURL != "" {
+		j.cmd.Env = append(j.cmd.Env, webhookURLEnv+"="+config.WebhookURL)
+	}
+	// the settings of the job itself win over the inherited ones
+	j.cmd.Env = append(j.cmd.Env, j.env...)
+	out, err := j.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	j.cmd.Stderr = j.cmd.Stdout
+	debugf("starting job %s: %v", j.name, j.args)
+	err = j.cmd.Start()
+	if err != nil {
+		return err
+	}
+	j.running = true
+	j.started = time.Now()
+	j.status = fmt.Sprintf("running (pid %d)", j.cmd.Process.Pid)
+	go func() {
+		in := bufio.NewScanner(out)
+		for in.Scan() {
+			log.Printf("[%s] %s", j.name, in.Text())
+		}
+		exited <- jobExit{j, j.cmd.Wait()}
+	}()
+	return nil
+}
+
+// restartWait returns how long to wait before the job is started again after
+// it failed at time now. A job that has been running for longer than
+// jobRestartMaxWait starts again with jobRestartWait.
+func (j *job) restartWait(now time.Time) time.Duration {
+	switch {
+	case j.wait == 0 || now.Sub(j.started) > jobRestartMaxWait:
+		j.wait = jobRestartWait
+	case j.wait*2 > jobRestartMaxWait:
+		j.wait = jobRestartMaxWait
+	default:
+		j.wait *= 2
+	}
+	return j.wait
+}
+
+func logJobStatus(jobs []*job) {
+	for _, j := range jobs {
+		log.Printf("job %s: %s", j.name, j.status)
+	}
+}
+
+// subcmdSupervise runs all jobs from the jobs file and waits until all of
+// them have exited. Jobs that fail are started again after a while, until
+// snaprd is told to exit. Signals are passed on to all running jobs.
+func subcmdSupervise() error {
+	jobs, err := readJobsFile(config.jobsFile, config.jobArgs)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	exited := make(chan jobExit)
+	// one pending restart per job at most, so sending never blocks
+	restart := make(chan *job, len(jobs))
+	// running counts the jobs that are running or about to be restarted
+	running := 0
+	stopping := false
+	var failed []string
+	for _, j := range jobs {
+		err := j.start(exe, exited)
+		if err != nil {
+			j.status = fmt.Sprintf("could not start: %v", err)
+			failed = append(failed, j.name)
+			continue
+		}
+		running++
+	}
+	logJobStatus(jobs)
+	for running > 0 {
+		select {
+		case sig := <-sigc:
+			log.Printf("passing signal %s to all jobs", sig)
+			for _, j := range jobs {
+				if j.running {
+					j.cmd.Process.Signal(sig)
+				}
+			}
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1:
+				stopping = true
+				for _, j := range jobs {
+					if j.restarting {
+						j.restarting = false
+						j.status += ", not restarted"
+						failed = append(failed, j.name)
+						running--
+					}
+				}
+				logJobStatus(jobs)
+			}
+		case e := <-exited:
+			e.j.running = false
+			switch {
+			case e.err == nil:
+				e.j.status = "exited"
+				running--
+			case stopping:
+				e.j.status = fmt.Sprintf("failed: %v", e.err)
+				failed = append(failed, e.j.name)
+				running--
+			default:
+				wait := e.j.restartWait(time.Now())
+				e.j.status = fmt.Sprintf("failed: %v, restarting in %s", e.err, wait)
+				e.j.restarting = true
+				j := e.j
+				time.AfterFunc(wait, func() { restart <- j })
+			}
+			logJobStatus(jobs)
+		case j := <-restart:
+			if !j.restarting {
+				// cancelled by a signal
+				continue
+			}
+			j.restarting = false
+			log.Printf("restarting job %s", j.name)
+			err := j.start(exe, exited)
+			if err != nil {
+				j.status = fmt.Sprintf("could not start: %v", err)
+				failed = append(failed, j.name)
+				running--
+			}
+			logJobStatus(jobs)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("jobs failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
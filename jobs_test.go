@@ -0,0 +1,146 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadJobsFile(t *testing.T) {
+	jobs, err := readJobsFile("testdata/snaprd.jobs", []string{"-schedFile=testdata/snaprd.schedules", "-notify=root"})
+	if err != nil {
+		t.Fatalf("readJobsFile() gave error %v", err)
+	}
+	wanted := [][]string{
+		{"run", "-schedFile=testdata/snaprd.schedules", "-notify=root",
+			"-noPurge=true", "-origin=fileserver:/export/home",
+			"-repository=/snapshots/home", `-rsyncOpts=["--exclude=.cache","--one-file-system"]`,
+			"-schedule=shortterm", "-noLogDate"},
+		{"run", "-schedFile=testdata/snaprd.schedules", "-notify=root",
+			"-maxKeep=4", "-origin=fileserver:/export/projects",
+			"-repository=/snapshots/projects", "-noLogDate"},
+	}
+	if len(jobs) != len(wanted) {
+		t.Fatalf("got %d jobs, wanted %d", len(jobs), len(wanted))
+	}
+	for i := range wanted {
+		if !reflect.DeepEqual(jobs[i].args, wanted[i]) {
+			t.Errorf("job %s: wanted %v, got %v", jobs[i].name, wanted[i], jobs[i].args)
+		}
+	}
+}
+
+func TestReadJobsFileListWithSpaces(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jobs")
+	ioutil.WriteFile(file, []byte(`{"a": {"origin": "/x", "repository": "/y", "rsyncOpts": ["--exclude=My Files"]}}`), 0644)
+	jobs, err := readJobsFile(file, nil)
+	if err != nil {
+		t.Fatalf("readJobsFile() gave error %v", err)
+	}
+	c := new(Config)
+	if err := newRunFlagSet(c).Parse(jobs[0].args[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if wanted := (opts{"--exclude=My Files"}); !reflect.DeepEqual(c.RsyncOpts, wanted) {
+		t.Errorf("job got RsyncOpts %q, wanted %q", c.RsyncOpts, wanted)
+	}
+}
+
+func TestReadJobsFileBad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	tests := []string{
+		`{}`,
+		`{"a": {"origin": "/x", "repository": "/y", "noSuchFlag": 1}}`,
+		`{"a": {"origin": "/x"}}`,
+		`{"a": {"origin": "/x", "repository": "/y", "maxKeep": "many"}}`,
+		`{"a": {"origin": "/x", "repository": "/y"}, "b": {"origin": "/z", "r": "/y"}}`,
+		`{"a": {"origin": "/x", "repository": "/y", "jobsFile": "/etc/snaprd.jobs"}}`,
+		`{"a": {"origin": "/x", "repository": "/y", "config": "/etc/snaprd.toml"}}`,
+	}
+	for _, s := range tests {
+		file := filepath.Join(dir, "jobs")
+		ioutil.WriteFile(file, []byte(s), 0644)
+		if _, err := readJobsFile(file, nil); err == nil {
+			t.Errorf("readJobsFile() did not fail for %s", s)
+		} else if !strings.HasPrefix(err.Error(), "job ") && s != `{}` {
+			t.Errorf("readJobsFile() error %q does not name the job", err)
+		}
+	}
+}
+
+func TestJobRestartWait(t *testing.T) {
+	j := &job{started: time.Now()}
+	now := j.started.Add(time.Minute)
+	wanted := []time.Duration{jobRestartWait, 2 * jobRestartWait, 4 * jobRestartWait}
+	for _, w := range wanted {
+		if got := j.restartWait(now); got != w {
+			t.Errorf("restartWait() = %s, wanted %s", got, w)
+		}
+	}
+	j.wait = jobRestartMaxWait
+	if got := j.restartWait(now); got != jobRestartMaxWait {
+		t.Errorf("restartWait() = %s, wanted at most %s", got, jobRestartMaxWait)
+	}
+	// a job that ran for a long time starts over
+	if got := j.restartWait(j.started.Add(2 * jobRestartMaxWait)); got != jobRestartWait {
+		t.Errorf("restartWait() = %s after a long run, wanted %s", got, jobRestartWait)
+	}
+}
+
+func TestJobSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	config = &Config{SmtpPassword: "inherited", WebhookURL: "http://hook/inherited"}
+	flags := newRunFlagSet(new(Config))
+	flags.Parse([]string{"-smtpUser=snaprd", "-smtpPassword=s3cret", "-webhookURL=http://hook/t0ken"})
+	if args := inheritedJobArgs(flags, nil); !reflect.DeepEqual(args, []string{"-smtpUser=snaprd"}) {
+		t.Errorf("inheritedJobArgs() gave %q, secrets must not be passed on the command line", args)
+	}
+	file := filepath.Join(dir, "jobs")
+	ioutil.WriteFile(file, []byte(`{
+		"a": {"origin": "/x", "repository": "/y", "smtpPassword": "s3cret", "webhookURL": "http://hook/t0ken"},
+		"b": {"origin": "/z", "repository": "/w"}
+	}`), 0644)
+	jobs, err := readJobsFile(file, nil)
+	if err != nil {
+		t.Fatalf("readJobsFile() gave error %v", err)
+	}
+	exe := filepath.Join(dir, "job.sh")
+	ioutil.WriteFile(exe, []byte("#!/bin/sh\necho \"$SNAPRD_SMTP_PASSWORD $SNAPRD_WEBHOOK_URL $*\"\n"), 0755)
+	wanted := []string{
+		"s3cret http://hook/t0ken run -origin=/x -repository=/y -noLogDate",
+		"inherited http://hook/inherited run -origin=/z -repository=/w -noLogDate",
+	}
+	for i, j := range jobs {
+		exited := make(chan jobExit)
+		out := new(bytes.Buffer)
+		log.SetOutput(out)
+		if err := j.start(exe, exited); err != nil {
+			t.Fatal(err)
+		}
+		<-exited
+		log.SetOutput(os.Stderr)
+		if !strings.Contains(out.String(), "["+j.name+"] "+wanted[i]) {
+			t.Errorf("job %s got %q, wanted %q", j.name, out.String(), wanted[i])
+		}
+	}
+	// the job takes the secrets from the environment
+	inheritedSmtpPassword = "s3cret"
+	inheritedWebhookURL = "http://hook/t0ken"
+	defer func() { inheritedSmtpPassword, inheritedWebhookURL = "", "" }()
+	c, _, err := parseRunArgs(nil)
+	if err != nil || c.SmtpPassword != "s3cret" || c.WebhookURL != "http://hook/t0ken" {
+		t.Errorf("parseRunArgs() did not take the inherited secrets: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Machine-readable output formats for the list subcommand
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// listSnapshot describes a snapshot for machine-readable list output.
+// Durations are given in seconds.
+type listSnapshot struct {
+	Interval  int
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  float64
+	State     string
+	Name      string
+	Path      string
+	Pinned    bool
+}
+
+// listInterval describes an interval of the schedule and the snapshots in it.
+// A Goal of 0 means there is no limit on the number of snapshots.
+type listInterval struct {
+	Interval  int
+	Spacing   float64
+	From      float64
+	Goal      int
+	Snapshots []listSnapshot
+}
+
+// listRepository is the top level object for the JSON list output.
+type listRepository struct {
+	Repository string
+	Origin     string
+	Schedule   string
+	Intervals  []listInterval
+}
+
+// listIntervals sorts the given snapshots into the intervals of the schedule,
+// starting with the oldest interval, like the text output of subcmdList. The
+// goal of the oldest interval is maxKeep.
+func listIntervals(snapshots snapshotList, intervals intervalList, maxKeep int, cl clock) []listInterval {
+	li := make([]listInterval, 0, len(intervals)-1)
+	for n := len(intervals) - 2; n >= 0; n-- {
+		iv := listInterval{
+			Interval:  n,
+			Spacing:   intervals[n].Seconds(),
+			From:      intervals.offset(n + 1).Seconds(),
+			Snapshots: []listSnapshot{},
+		}
+		if n < len(intervals)-2 {
+			iv.Goal = intervals.goal(n)
+		} else {
+			iv.Goal = maxKeep
+		}
+		for _, sn := range snapshots.interval(intervals, n, cl) {
+			ls := listSnapshot{
+				Interval:  n,
+				StartTime: sn.startTime,
+				State:     sn.state.String(),
+				Name:      sn.Name(),
+				Path:      sn.FullName(),
+				Pinned:    sn.pinned(),
+			}
+			if sn.endTime.After(sn.startTime) {
+				ls.EndTime = sn.endTime
+				ls.Duration = sn.endTime.Sub(sn.startTime).Seconds()
+			}
+			iv.Snapshots = append(iv.Snapshots, ls)
+		}
+		li = append(li, iv)
+	}
+	return li
+}
+
+// writeListJSON writes the repository contents as one JSON object to w.
+func writeListJSON(w io.Writer, li []listInterval) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(listRepository{
+		Repository: config.repository,
+		Origin:     config.Origin,
+		Schedule:   config.Schedule,
+		Intervals:  li,
+	})
+}
+
+// writeListCSV writes the repository contents to w, one snapshot per line.
+func writeListCSV(w io.Writer, li []listInterval) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"interval", "goal", "start", "end", "duration", "state", "name", "path", "pinned"})
+	for _, iv := range li {
+		for _, ls := range iv.Snapshots {
+			var end string
+			if !ls.EndTime.IsZero() {
+				end = ls.EndTime.Format(time.RFC3339)
+			}
+			cw.Write([]string{
+				strconv.Itoa(ls.Interval),
+				strconv.Itoa(iv.Goal),
+				ls.StartTime.Format(time.RFC3339),
+				end,
+				fmt.Sprintf("%.0f", ls.Duration),
+				ls.State,
+				ls.Name,
+				ls.Path,
+				strconv.FormatBool(ls.Pinned),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,73 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestListIntervals(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	cl := newSkewClock(startAt)
+	sl, _ := findSnapshots(cl)
+	li := listIntervals(sl, schedules[config.Schedule], config.MaxKeep, cl)
+	// same numbers as in the text output of Example_subcmdList
+	wanted := []struct{ interval, goal, count int }{
+		{3, 2, 1},
+		{2, 2, 2},
+		{1, 2, 2},
+		{0, 4, 4},
+	}
+	if len(li) != len(wanted) {
+		t.Fatalf("got %d intervals, wanted %d", len(li), len(wanted))
+	}
+	for i, w := range wanted {
+		if li[i].Interval != w.interval || li[i].Goal != w.goal || len(li[i].Snapshots) != w.count {
+			t.Errorf("interval %d: got %d, %d/%d, wanted %d, %d/%d", i,
+				li[i].Interval, len(li[i].Snapshots), li[i].Goal,
+				w.interval, w.count, w.goal)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeListJSON(&buf, li); err != nil {
+		t.Errorf("writeListJSON() gave error %v", err)
+	}
+	var lr listRepository
+	if err := json.Unmarshal(buf.Bytes(), &lr); err != nil {
+		t.Errorf("could not read back JSON output: %v", err)
+	}
+	if sn := lr.Intervals[0].Snapshots[0]; sn.Name != mockSnapshots[0] || sn.Duration != 1 {
+		t.Errorf("JSON output has wrong first snapshot: %+v", sn)
+	}
+}
+
+func TestWriteListCSV(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	cl := newSkewClock(startAt)
+	sl, _ := findSnapshots(cl)
+	var buf bytes.Buffer
+	if err := writeListCSV(&buf, listIntervals(sl, schedules[config.Schedule], config.MaxKeep, cl)); err != nil {
+		t.Errorf("writeListCSV() gave error %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(mockSnapshots)+1 {
+		t.Fatalf("got %d lines of CSV output, wanted %d", len(lines), len(mockSnapshots)+1)
+	}
+	if lines[0] != "interval,goal,start,end,duration,state,name,path,pinned" {
+		t.Errorf("wrong CSV header: %s", lines[0])
+	}
+	f := strings.Split(lines[1], ",")
+	if f[0] != "3" || f[1] != "2" || f[4] != "1" || f[5] != "Complete" || f[6] != mockSnapshots[0] {
+		t.Errorf("wrong CSV line: %s", lines[1])
+	}
+}
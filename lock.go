@@ -1,46 +1,132 @@
 /* See the file "LICENSE.txt" for the full license governing this code. */
 
-// Simple lock file mechanism to prevent multiple instances to run
+// Lock file mechanism to prevent multiple instances to run
+// The lock is held with flock(2), so it is released by the kernel when the
+// process dies. A lock file left behind after a crash is not in the way.
 
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
-type pidLocker struct {
-	pid int
-	f   string
+// lockInfo is written to the lock file to tell who holds the lock.
+type lockInfo struct {
+	Pid      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
 }
 
-func newPidLocker(lockfile string) *pidLocker {
-	return &pidLocker{
-		pid: os.Getpid(),
-		f:   lockfile,
+func (li *lockInfo) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", li.Pid, li.Hostname, li.Started.Format("2006-01-02 15:04:05"))
+}
+
+type repoLocker struct {
+	f    string
+	file *os.File
+}
+
+// lockFile returns the path of the lock file of the repository.
+func lockFile(repository string) string {
+	return filepath.Join(repository, ".pid")
+}
+
+func newRepoLocker(repository string) *repoLocker {
+	return &repoLocker{f: lockFile(repository)}
+}
+
+// readLockInfo reads the lock file. Lock files of older versions only
+// contain the pid, they are returned with pid 0.
+func readLockInfo(f string) (*lockInfo, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	li := new(lockInfo)
+	if json.Unmarshal(b, li) != nil {
+		return new(lockInfo), nil
 	}
+	return li, nil
 }
 
-func (pl *pidLocker) Lock() error {
-	_, err := os.Stat(pl.f)
+// Lock takes the exclusive lock of the repository. It fails immediately if
+// another process holds it.
+func (rl *repoLocker) Lock() error {
+	file, err := os.OpenFile(rl.f, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open lock file %s: %s", rl.f, err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			if li, err := readLockInfo(rl.f); err == nil && li.Pid != 0 {
+				return fmt.Errorf("repository is locked by %s. Is snaprd running already?", li)
+			}
+			return fmt.Errorf("repository is locked (%s). Is snaprd running already?", rl.f)
+		}
+		return fmt.Errorf("could not lock %s: %s", rl.f, err)
+	}
+	if li, err := readLockInfo(rl.f); err == nil && li.Pid != 0 {
+		log.Printf("removing stale lock of %s", li)
+	}
+	host, _ := os.Hostname()
+	b, err := json.Marshal(&lockInfo{Pid: os.Getpid(), Hostname: host, Started: time.Now()})
+	if err == nil {
+		err = file.Truncate(0)
+	}
 	if err == nil {
-		return fmt.Errorf("pid file %s already exists. Is snaprd running already?", pl.f)
+		_, err = file.WriteAt(append(b, '\n'), 0)
 	}
-	debugf("write pid %d to pidfile %s", pl.pid, pl.f)
-	err = ioutil.WriteFile(pl.f, []byte(strconv.Itoa(pl.pid)), 0666)
 	if err != nil {
-		return fmt.Errorf("could not write pid file %s: %s", pl.f, err)
+		file.Close()
+		return fmt.Errorf("could not write lock file %s: %s", rl.f, err)
 	}
+	debugf("locked %s", rl.f)
+	rl.file = file
 	return nil
 }
 
-func (pl *pidLocker) Unlock() {
-	debugf("delete pidfile %s", pl.f)
-	err := os.Remove(pl.f)
+// Unlock releases the lock. The lock file is emptied, but not removed,
+// because another process could have it open already.
+func (rl *repoLocker) Unlock() {
+	if rl.file == nil {
+		return
+	}
+	debugf("unlocking %s", rl.f)
+	err := rl.file.Truncate(0)
+	if err != nil {
+		log.Printf("could not empty lock file %s: %s", rl.f, err)
+	}
+	rl.file.Close()
+	rl.file = nil
+}
+
+// lockHolder returns the information about the process holding the lock of
+// the repository, or nil if it is not locked.
+func lockHolder(repository string) *lockInfo {
+	f := lockFile(repository)
+	file, err := os.Open(f)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	// if the lock can be taken, nobody holds it
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return nil
+	}
+	li, err := readLockInfo(f)
 	if err != nil {
-		log.Printf("could not remove pid file %s: %s", pl.f, err)
+		return new(lockInfo)
 	}
+	return li
 }
@@ -0,0 +1,62 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRepoLocker(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	rl := newRepoLocker(config.repository)
+	if err := rl.Lock(); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	li := lockHolder(config.repository)
+	if li == nil || li.Pid != os.Getpid() {
+		t.Errorf("lockHolder() = %v, wanted pid %d", li, os.Getpid())
+	}
+	// flock locks of different open files conflict even in one process
+	err := newRepoLocker(config.repository).Lock()
+	if err == nil || !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("second Lock() returned %v, wanted an error naming the holder", err)
+	}
+	rl.Unlock()
+	if li := lockHolder(config.repository); li != nil {
+		t.Errorf("lockHolder() = %v after Unlock(), wanted nil", li)
+	}
+	if err := rl.Lock(); err != nil {
+		t.Errorf("Lock() after Unlock() failed: %v", err)
+	}
+	rl.Unlock()
+}
+
+func TestRepoLockerStale(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	for _, content := range []string{
+		// left behind by a crashed process
+		`{"pid":999999,"hostname":"elsewhere","started":"2014-05-17T16:38:51Z"}`,
+		// left behind by an older version
+		"12345",
+	} {
+		ioutil.WriteFile(lockFile(config.repository), []byte(content), 0644)
+		if li := lockHolder(config.repository); li != nil {
+			t.Errorf("lockHolder() = %v for a stale lock file, wanted nil", li)
+		}
+		rl := newRepoLocker(config.repository)
+		if err := rl.Lock(); err != nil {
+			t.Errorf("Lock() failed with stale lock file %q: %v", content, err)
+		}
+		li, err := readLockInfo(lockFile(config.repository))
+		if err != nil || li.Pid != os.Getpid() {
+			t.Errorf("lock file contains %v, %v, wanted pid %d", li, err, os.Getpid())
+		}
+		rl.Unlock()
+	}
+}
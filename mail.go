@@ -1,13 +1,45 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Notifications by mail
+// Mails are either handed over to the "mail" command of the system, or sent
+// directly to an SMTP server.
+
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
+	"net/smtp"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// smtpTimeout limits the time to connect to the SMTP server.
+const smtpTimeout = time.Second * 30
+
+// smtpPasswordEnv is used to hand the SMTP password from the jobs supervisor
+// to the jobs, so it does not show up on their command lines.
+const smtpPasswordEnv = "SNAPRD_SMTP_PASSWORD"
+
+// inheritedSmtpPassword is the SMTP password handed over by the supervisor.
+// It is removed from the environment, so hooks and rsync do not see it.
+var inheritedSmtpPassword = takeEnv(smtpPasswordEnv)
+
+// takeEnv returns the value of the environment variable name and removes it.
+func takeEnv(name string) string {
+	v := os.Getenv(name)
+	os.Unsetenv(name)
+	return v
+}
+
 func FailureMail(exitCode int, logBuffer *RingIO) {
+	config := currentConfig()
 	mail := fmt.Sprintf("snaprd exited with return value %d.\nLatest log output:\n\n%s",
 		exitCode, logBuffer.GetAsText())
 	subject := fmt.Sprintf("snaprd failure (origin: %s)", config.Origin)
@@ -15,6 +47,7 @@ func FailureMail(exitCode int, logBuffer *RingIO) {
 }
 
 func RsyncIssueMail(rsyncError error, rsyncErrorCode int) {
+	config := currentConfig()
 	var errText string
 	if s, ok := rsyncIgnoredErrors[rsyncErrorCode]; ok == true {
 		errText = s
@@ -33,23 +66,115 @@ func NotifyMail(to, msg string) {
 	SendMail(to, "snaprd notice", msg)
 }
 
-func SendMail(to, subject, msg string) {
+// SendMail delivers a mail using the backend selected by -mailBackend. Errors
+// are logged and counted in the metrics, so callers may ignore them.
+func SendMail(to, subject, msg string) error {
+	config := currentConfig()
+	var err error
+	switch config.MailBackend {
+	case "smtp":
+		err = sendMailSMTP(to, subject, msg)
+	default:
+		err = sendMailCommand(to, subject, msg)
+	}
+	metrics.notificationSent(err)
+	if err != nil {
+		log.Printf("could not send notification to %s: %s", to, err)
+		return err
+	}
+	log.Printf("sending notification to %s done\n", to)
+	return nil
+}
+
+// sendMailCommand hands the mail over to the "mail" command.
+func sendMailCommand(to, subject, msg string) error {
 	sendmail := exec.Command("mail", "-s", subject, to)
-	stdin, err := sendmail.StdinPipe()
+	sendmail.Stdin = strings.NewReader(msg + "\n")
+	out, err := sendmail.CombinedOutput()
 	if err != nil {
-		log.Println(err)
-		return
+		if len(out) > 0 {
+			return fmt.Errorf("mail command failed: %s: %s", err, bytes.TrimSpace(out))
+		}
+		return fmt.Errorf("mail command failed: %s", err)
 	}
-	stdout, err := sendmail.StdoutPipe()
+	return nil
+}
+
+// mailFrom returns the sender address, by default snaprd@<hostname>.
+func mailFrom() string {
+	config := currentConfig()
+	if config.MailFrom != "" {
+		return config.MailFrom
+	}
+	host, err := os.Hostname()
 	if err != nil {
-		log.Println(err)
-		return
+		host = "localhost"
 	}
-	sendmail.Start()
-	stdin.Write([]byte(msg))
-	stdin.Write([]byte("\n"))
-	stdin.Close()
-	ioutil.ReadAll(stdout)
-	sendmail.Wait()
-	log.Printf("sending notification to %s done\n", to)
+	return myName + "@" + host
+}
+
+// composeMail returns the mail with all necessary headers.
+func composeMail(from, to, subject, msg string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	b.WriteString(strings.Replace(msg, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// sendMailSMTP delivers the mail to the SMTP server given by -smtpHost and
+// -smtpPort.
+func sendMailSMTP(to, subject, msg string) error {
+	config := currentConfig()
+	if config.SmtpHost == "" {
+		return fmt.Errorf("no SMTP host configured")
+	}
+	addr := net.JoinHostPort(config.SmtpHost, strconv.Itoa(config.SmtpPort))
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, config.SmtpHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if config.SmtpStartTLS {
+		err = c.StartTLS(&tls.Config{ServerName: config.SmtpHost})
+		if err != nil {
+			return fmt.Errorf("STARTTLS failed: %s", err)
+		}
+	}
+	if config.SmtpUser != "" {
+		err = c.Auth(smtp.PlainAuth("", config.SmtpUser, config.SmtpPassword, config.SmtpHost))
+		if err != nil {
+			return fmt.Errorf("authentication failed: %s", err)
+		}
+	}
+	from := mailFrom()
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(composeMail(from, to, subject, msg, time.Now()))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
 }
@@ -0,0 +1,138 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts one connection and records the session. If
+// rejectRcpt is set, all recipients are refused.
+func fakeSMTPServer(t *testing.T, rejectRcpt bool) (addr string, session chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session = make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			if inData {
+				if line == "." {
+					inData = false
+					reply("250 queued")
+				}
+				continue
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250-fake")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(line, "AUTH"):
+				reply("235 ok")
+			case strings.HasPrefix(line, "RCPT") && rejectRcpt:
+				reply("550 no such user")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				session <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		session <- lines
+	}()
+	return l.Addr().String(), session
+}
+
+func mockSMTPConfig(addr string) {
+	mockConfig()
+	host, port, _ := net.SplitHostPort(addr)
+	config.MailBackend = "smtp"
+	config.SmtpHost = host
+	config.SmtpPort, _ = strconv.Atoi(port)
+	config.MailFrom = "snaprd@example.com"
+}
+
+func TestSendMailSMTP(t *testing.T) {
+	addr, session := fakeSMTPServer(t, false)
+	mockSMTPConfig(addr)
+	defer os.RemoveAll(config.repository)
+	config.SmtpUser = "snaprd"
+	config.SmtpPassword = "secret"
+	metrics = newMetricsRegistry()
+	err := SendMail("admin@example.com", "snaprd notice", "hello\nworld")
+	if err != nil {
+		t.Fatalf("SendMail() returned an error, but it shouldn't: %v", err)
+	}
+	got := strings.Join(<-session, "\n")
+	for _, want := range []string{
+		"AUTH PLAIN",
+		"MAIL FROM:<snaprd@example.com>",
+		"RCPT TO:<admin@example.com>",
+		"Subject: snaprd notice",
+		"hello\nworld\n.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("SMTP session does not contain %q:\n%s", want, got)
+		}
+	}
+	if metrics.notifications != 1 || metrics.notifyErrors != 0 {
+		t.Errorf("metrics counted %d notifications, %d errors, wanted 1, 0", metrics.notifications, metrics.notifyErrors)
+	}
+}
+
+func TestSendMailSMTPRejected(t *testing.T) {
+	addr, session := fakeSMTPServer(t, true)
+	mockSMTPConfig(addr)
+	defer os.RemoveAll(config.repository)
+	metrics = newMetricsRegistry()
+	err := SendMail("nobody@example.com", "snaprd notice", "hello")
+	if err == nil {
+		t.Errorf("SendMail() succeeded, but the recipient was rejected")
+	}
+	<-session
+	if metrics.notifyErrors != 1 {
+		t.Errorf("metrics counted %d notification errors, wanted 1", metrics.notifyErrors)
+	}
+}
+
+func TestComposeMail(t *testing.T) {
+	date := time.Date(2014, 5, 17, 16, 38, 51, 0, time.UTC)
+	got := string(composeMail("a@example.com", "b@example.com", "test", "line 1\nline 2", date))
+	wanted := "From: a@example.com\r\n" +
+		"To: b@example.com\r\n" +
+		"Subject: test\r\n" +
+		"Date: Sat, 17 May 2014 16:38:51 +0000\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"line 1\r\nline 2\r\n"
+	if got != wanted {
+		t.Errorf("composeMail() = %q, wanted %q", got, wanted)
+	}
+}
@@ -15,7 +15,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -31,12 +31,30 @@ func debugf(format string, args ...interface{}) {
 	}
 }
 
+// nextWait returns how long to wait after the snapshot sn before the next
+// one is due. Usually that is the first interval, counted from the start of
+// sn. With -align, the next snapshot is due at the start of the next
+// calendar period.
+func nextWait(sn *snapshot, cl clock) time.Duration {
+	config, schedules := currentSettings()
+	gap := cl.Now().Sub(sn.startTime)
+	debugf("gap: %s", gap)
+	if al := config.alignment(); al != nil {
+		_, next := al.period(sn.startTime, schedules[config.Schedule][0])
+		debugf("next aligned snapshot at %s", next)
+		return next.Sub(cl.Now())
+	}
+	return schedules[config.Schedule][0] - gap
+}
+
 // lastGoodTicker is the clock for the create loop. It takes the last
 // created snapshot on its input channel and outputs it on the output channel,
 // but only after an appropriate waiting time. To start things off, the first
-// lastGood snapshot has to be read from disk.
-func lastGoodTicker(in, out chan *snapshot, cl clock) {
-	var gap, wait time.Duration
+// lastGood snapshot has to be read from disk. Sending to force skips the
+// waiting time, like SIGUSR2. A notification on reload makes it compute the
+// waiting time again with the new settings.
+func lastGoodTicker(in, out chan *snapshot, force chan struct{}, reload <-chan struct{}, cl clock) {
+	var wait time.Duration
 	var sn *snapshot
 	sn = lastGoodFromDisk(cl)
 	if sn != nil {
@@ -50,20 +68,30 @@ func lastGoodTicker(in, out chan *snapshot, cl clock) {
 	for {
 		sn := <-in
 		if sn != nil {
-			gap = cl.Now().Sub(sn.startTime)
-			debugf("gap: %s", gap)
-			wait = schedules[config.Schedule][0] - gap
-			if wait > 0 {
-				sigc := make(chan os.Signal, 1)
-				signal.Notify(sigc, syscall.SIGUSR2)
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, syscall.SIGUSR2)
+		WAIT:
+			for {
+				wait = nextWait(sn, cl)
+				if wait <= 0 {
+					break
+				}
 				log.Println("wait", wait, "before next snapshot")
 				select {
 				case <-sigc:
 					log.Println("Snapshot forced by signal, skipping wait time.")
+					break WAIT
+				case <-force:
+					log.Println("Snapshot forced by control socket, skipping wait time.")
+					break WAIT
+				case <-reload:
+					debugf("settings reloaded, computing wait time again")
 				case <-time.After(wait):
 					debugf("Awoken at %s\n", cl.Now())
+					break WAIT
 				}
 			}
+			signal.Stop(sigc)
 		}
 		out <- sn
 	}
@@ -72,13 +100,16 @@ func lastGoodTicker(in, out chan *snapshot, cl clock) {
 // subcmdRun is the main, long-running routine and starts off a couple of
 // helper goroutines.
 func subcmdRun() (ferr error) {
-	pl := newPidLocker(filepath.Join(config.repository, ".pid"))
-	err := pl.Lock()
+	rl := newRepoLocker(config.repository)
+	err := rl.Lock()
 	if err != nil {
 		ferr = err
 		return
 	}
-	defer pl.Unlock()
+	defer rl.Unlock()
+	defer os.Remove(controlSocket(config.repository))
+	d := newDaemon()
+	go watchReload(d)
 	if !config.NoWait {
 		sigc := make(chan os.Signal, 1)
 		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
@@ -102,7 +133,16 @@ func subcmdRun() (ferr error) {
 	freeSpaceCheck := make(chan struct{})
 
 	cl := new(realClock)
-	go lastGoodTicker(lastGoodIn, lastGoodOut, cl)
+	go lastGoodTicker(lastGoodIn, lastGoodOut, d.force, d.onReload(), cl)
+	go serveControl(d, obsoleteQueue, cl)
+
+	// both may be switched on and off by a reload
+	go runWatchdog(cl, d.onReload())
+	go runDigest(cl, d.onReload())
+
+	if config.MetricsListen != "" {
+		go serveMetrics(config.MetricsListen, obsoleteQueue)
+	}
 
 	// Snapshot creation loop
 	go func() {
@@ -111,13 +151,38 @@ func subcmdRun() (ferr error) {
 	CREATE_LOOP:
 		for {
 			debugf("start of create loop")
+			// while paused, the next snapshot is not taken from the ticker
+			ticks := lastGoodOut
+			if d.isPaused() {
+				ticks = nil
+			}
 			select {
 			case <-createExit:
 				debugf("gracefully exiting snapshot creation goroutine")
 				lastGoodOut = nil
 				break CREATE_LOOP
-			case lastGood = <-lastGoodOut:
+			case <-d.changed:
+				continue
+			case f := <-d.safe:
+				f()
+			case lastGood = <-ticks:
+				d.setCreating(true)
+				// a snapshot requested meanwhile is this one
+				select {
+				case <-d.force:
+				default:
+				}
 				sn, err := createSnapshot(lastGood)
+				d.setCreating(false)
+				if _, ok := err.(skipError); ok {
+					// try again after one interval, without pruning
+					log.Println(err)
+					go func(sn *snapshot, wait time.Duration) {
+						time.Sleep(wait)
+						lastGoodIn <- sn
+					}(lastGood, schedules[config.Schedule][0])
+					continue
+				}
 				if err != nil || sn == nil {
 					debugf("snapshot creation finally failed (%s), the partial transfer will hopefully be reused", err)
 					createError = err
@@ -158,54 +223,62 @@ func subcmdRun() (ferr error) {
 	// Purger loop
 	go func() {
 		for {
-			if sn := <-obsoleteQueue; !config.NoPurge {
+			sn := <-obsoleteQueue
+			if sn.pinned() {
+				log.Printf("not purging pinned snapshot %s", sn.Name())
+			} else if !currentConfig().NoPurge {
 				sn.purge()
 			}
 		}
 	}()
 	debugf("started purge goroutine")
 
-	// If we are going to automatically purge all expired snapshots, we
-	// needn't even starting the gofunc
-	if config.NoPurge {
-		// Free space claiming function
-		go func() {
-			for {
-				// Wait until we are ordered to do something
-				<-freeSpaceCheck
-				// Get all obsolete snapshots
-				// This returns a sorted list
-				snapshots, err := findSnapshots(cl)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				if len(snapshots) < 2 {
-					log.Println("less than 2 snapshots found, not pruning")
-					return
-				}
-				obsolete := snapshots.state(stateObsolete, none)
-				// We only delete as long as we need *AND* we have something to delete
-				for !checkFreeSpace(config.repository, config.MinPercSpace, config.MinGiBSpace) && len(obsolete) > 0 {
-					// If there is not enough space, purge the oldest snapshot
-					last := len(obsolete) - 1
-					obsolete[last].purge()
-					// We remove it from the list, it's quicker than recalculating the list.
-					obsolete = obsolete[:last]
-				}
+	// Free space claiming function. It only gets work if we are not going
+	// to automatically purge all expired snapshots, but -noPurge may be
+	// switched on by a reload, so it is always started.
+	go func() {
+		for {
+			// Wait until we are ordered to do something
+			<-freeSpaceCheck
+			config := currentConfig()
+			// Get all obsolete snapshots
+			// This returns a sorted list
+			snapshots, err := findSnapshots(cl)
+			if err != nil {
+				log.Println(err)
+				return
 			}
-		}()
-	}
+			if len(snapshots) < 2 {
+				log.Println("less than 2 snapshots found, not pruning")
+				return
+			}
+			obsolete := snapshots.state(stateObsolete, none).unpinned()
+			// We only delete as long as we need *AND* we have something to delete
+			for !checkFreeSpace(config.repository, config.MinPercSpace, config.MinGiBSpace) && len(obsolete) > 0 {
+				// If there is not enough space, purge the oldest snapshot
+				last := len(obsolete) - 1
+				obsolete[last].purge()
+				// We remove it from the list, it's quicker than recalculating the list.
+				obsolete = obsolete[:last]
+			}
+		}
+	}()
 
 	// Global signal handling
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 	select {
+	case <-d.stop:
+		log.Println("-> Graceful exit (control socket)")
+		createExit <- true
+		ferr = <-createExitDone
 	case sig := <-sigc:
 		debugf("Got signal %s", sig)
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
 			log.Println("-> Immediate exit")
+			// the create loop got the signal as well and terminates rsync
+			d.waitCreated(rsyncKillGrace * 2)
 		case syscall.SIGUSR1:
 			log.Println("-> Graceful exit")
 			createExit <- true
@@ -219,7 +292,7 @@ func subcmdRun() (ferr error) {
 }
 
 // subcmdList give the user an overview of what's in the repository.
-func subcmdList(cl clock) {
+func subcmdList(cl clock) error {
 	intervals := schedules[config.Schedule]
 	if cl == nil {
 		cl = new(realClock)
@@ -228,13 +301,19 @@ func subcmdList(cl clock) {
 	if err != nil {
 		log.Println(err)
 	}
+	if config.showAll {
+		snapshots = snapshots.state(any, none)
+	} else {
+		snapshots = snapshots.state(stateComplete|statePartial, none)
+	}
+	switch config.listFormat {
+	case "json":
+		return writeListJSON(os.Stdout, listIntervals(snapshots, intervals, config.MaxKeep, cl))
+	case "csv":
+		return writeListCSV(os.Stdout, listIntervals(snapshots, intervals, config.MaxKeep, cl))
+	}
 	for n := len(intervals) - 2; n >= 0; n-- {
 		debugf("listing interval %d", n)
-		if config.showAll {
-			snapshots = snapshots.state(any, none)
-		} else {
-			snapshots = snapshots.state(stateComplete, none)
-		}
 		snapshots := snapshots.interval(intervals, n, cl)
 		debugf("snapshots in interval %d: %s", n, snapshots)
 		if n < len(intervals)-2 {
@@ -263,13 +342,32 @@ func subcmdList(cl clock) {
 			if sn.endTime.After(sn.startTime) {
 				dur = sn.endTime.Sub(sn.startTime)
 			}
+			m, err := sn.readMeta()
+			if err != nil {
+				log.Printf("could not read metadata of %s: %s", sn.Name(), err)
+			}
 			if config.verbose {
-				fmt.Printf("%d %s (%s, %s/%s, %s) \"%s\"\n", n, stime, dur, intervals[n], dist, sn.state, sn.Name())
+				fmt.Printf("%d %s (%s, %s/%s, %s) \"%s\"", n, stime, dur, intervals[n], dist, sn.state, sn.Name())
+				if m.Stats != nil {
+					fmt.Printf(" [%s]", m.Stats)
+				}
 			} else {
-				fmt.Printf("%s (%s, %s)\n", stime, dur, intervals[n])
+				fmt.Printf("%s (%s, %s)", stime, dur, intervals[n])
+			}
+			if sn.state == statePartial {
+				ct.Foreground(ct.Red, false)
+				fmt.Print(" partial")
+				ct.ResetColor()
 			}
+			if m.Pinned {
+				ct.Foreground(ct.Cyan, false)
+				fmt.Print(" pinned")
+				ct.ResetColor()
+			}
+			fmt.Println()
 		}
 	}
+	return nil
 }
 
 func mainExitCode(logIO io.Writer) int {
@@ -280,6 +378,10 @@ func mainExitCode(logIO io.Writer) int {
 		if err == flag.ErrHelp {
 			return 0
 		}
+		if subcmd == "status" && err != nil {
+			fmt.Printf("SNAPRD %s - %s\n", nagiosNames[nagiosUnknown], strings.TrimSpace(err.Error()))
+			return nagiosUnknown
+		}
 		log.Println(err)
 		return 1
 	}
@@ -290,6 +392,15 @@ func mainExitCode(logIO io.Writer) int {
 	switch subcmd {
 	case "run":
 		log.Printf("%s %s started with pid %d\n", myName, version, os.Getpid())
+		if config.jobsFile != "" {
+			log.Printf("### Jobs: %s\n", config.jobsFile)
+			err = subcmdSupervise()
+			if err != nil {
+				log.Println(err)
+				return 2
+			}
+			break
+		}
 		log.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
 		err = subcmdRun()
 		if err != nil {
@@ -300,23 +411,68 @@ func mainExitCode(logIO io.Writer) int {
 		if config.noColor {
 			ct.Writer = ioutil.Discard
 		}
-		ct.Foreground(ct.Green, false)
-		fmt.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
-		ct.ResetColor()
-		subcmdList(nil)
+		if config.listFormat == "text" {
+			ct.Foreground(ct.Green, false)
+			fmt.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
+			ct.ResetColor()
+		}
+		err = subcmdList(nil)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
 	case "scheds":
-		schedules.list()
+		if config.schedCheck != "" {
+			err = checkScheduleFile(config.schedCheck)
+			if err != nil {
+				log.Println(err)
+				return 2
+			}
+			break
+		}
+		err = schedules.list(os.Stdout, config.schedFormat, config.MaxKeep)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+	case "pin", "unpin":
+		err = subcmdPin(subcmd == "pin", nil)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+	case "simulate":
+		subcmdSimulate()
+	case "status":
+		return subcmdStatus(nil)
+	case "ctl":
+		err = subcmdCtl()
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+	case "prune":
+		err = subcmdPrune(nil)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+	case "restore":
+		err = subcmdRestore(nil)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
 	}
 	return 0
 }
 
 func main() {
-	rio := newRingIO(os.Stderr, 25, 100)
-	exitCode := mainExitCode(rio)
+	exitCode := mainExitCode(logBuffer)
 	// do not send a notification when error code is 0 or 1 (error in flag handling)
 	// because in the case 1 we can not access the config yet.
-	if exitCode > 1 && config.Notify != "" {
-		FailureMail(exitCode, rio)
+	if exitCode > 1 && currentConfig() != nil {
+		notifyFailure(exitCode)
 	}
 	os.Exit(exitCode)
 }
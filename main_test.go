@@ -2,7 +2,7 @@ package main
 
 import "os"
 
-func ExampleSubcmdList() {
+func Example_subcmdList() {
 	mockConfig()
 	mockRepository()
 	defer os.RemoveAll(config.repository)
@@ -24,12 +24,41 @@ func ExampleSubcmdList() {
 	// 2014-05-17 Saturday 16:42:01 (1s, 5s)
 }
 
-func ExampleScheds() {
-	schedules.list()
+func Example_scheds() {
+	schedules.list(os.Stdout, "text", 0)
 	// Output:
-	// longterm: [6h0m0s 24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// shortterm: [10m0s 2h0m0s 24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// test1: [24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// testing: [5s 20s 2m20s 4m40s 876000h0m0s]
-	// testing2: [5s 20s 40s 1m20s 876000h0m0s]
+	// longterm: [6h 1d 1w 1M forever]
+	//   every 1M from past to 1M1w1d ago: ∞
+	//   every 1w from 1M1w1d ago to 1w1d ago: 4
+	//   every 1d from 1w1d ago to 1d ago: 7
+	//   every 6h from 1d ago to now: 4
+	//   snapshots: 15 plus one every 1M, retention: forever
+	//
+	// shortterm: [10m 2h 1d 1w 1M forever]
+	//   every 1M from past to 1M1w1d2h ago: ∞
+	//   every 1w from 1M1w1d2h ago to 1w1d2h ago: 4
+	//   every 1d from 1w1d2h ago to 1d2h ago: 7
+	//   every 2h from 1d2h ago to 2h ago: 12
+	//   every 10m from 2h ago to now: 12
+	//   snapshots: 35 plus one every 1M, retention: forever
+	//
+	// test1: [1d 1w 1M forever]
+	//   every 1M from past to 1M1w ago: ∞
+	//   every 1w from 1M1w ago to 1w ago: 4
+	//   every 1d from 1w ago to now: 7
+	//   snapshots: 11 plus one every 1M, retention: forever
+	//
+	// testing: [5s 20s 2m20s 4m40s forever]
+	//   every 4m40s from past to 7m20s ago: ∞
+	//   every 2m20s from 7m20s ago to 2m40s ago: 2
+	//   every 20s from 2m40s ago to 20s ago: 7
+	//   every 5s from 20s ago to now: 4
+	//   snapshots: 13 plus one every 4m40s, retention: forever
+	//
+	// testing2: [5s 20s 40s 1m20s forever]
+	//   every 1m20s from past to 2m20s ago: ∞
+	//   every 40s from 2m20s ago to 1m ago: 2
+	//   every 20s from 1m ago to 20s ago: 2
+	//   every 5s from 20s ago to now: 4
+	//   snapshots: 8 plus one every 1m20s, retention: forever
 }
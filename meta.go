@@ -0,0 +1,192 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Additional per-snapshot information stored next to the snapshots
+// Parsing of rsync --stats output
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rsyncStats holds the numbers rsync prints at the end of a run with --stats,
+// plus some information snaprd itself knows about the run.
+type rsyncStats struct {
+	Files            int64
+	CreatedFiles     int64
+	DeletedFiles     int64
+	TransferredFiles int64
+	TotalSize        int64
+	TransferredSize  int64
+	LiteralData      int64
+	MatchedData      int64
+	BytesSent        int64
+	BytesReceived    int64
+	ExitCode         int
+	Duration         float64 // in seconds
+}
+
+// parseLine looks at one line of rsync output and stores the value if it is
+// part of the --stats block. All other lines are ignored.
+func (st *rsyncStats) parseLine(line string) {
+	fields := map[string]*int64{
+		"Number of files":                     &st.Files,
+		"Number of created files":             &st.CreatedFiles,
+		"Number of deleted files":             &st.DeletedFiles,
+		"Number of regular files transferred": &st.TransferredFiles,
+		"Number of files transferred":         &st.TransferredFiles,
+		"Total file size":                     &st.TotalSize,
+		"Total transferred file size":         &st.TransferredSize,
+		"Literal data":                        &st.LiteralData,
+		"Matched data":                        &st.MatchedData,
+		"Total bytes sent":                    &st.BytesSent,
+		"Total bytes received":                &st.BytesReceived,
+	}
+	i := strings.Index(line, ":")
+	if i == -1 {
+		return
+	}
+	p, ok := fields[line[:i]]
+	if !ok {
+		return
+	}
+	value := strings.Fields(line[i+1:])
+	if len(value) == 0 {
+		return
+	}
+	n, err := parseRsyncNumber(value[0])
+	if err != nil {
+		debugf("could not parse rsync stats line \"%s\": %s", line, err)
+		return
+	}
+	*p = n
+}
+
+// parseRsyncNumber converts a number as printed by rsync into an integer.
+// Depending on the locale and the --human-readable setting this can look like
+// "1234", "1,234", "1.234" or "1.23K".
+func parseRsyncNumber(s string) (int64, error) {
+	var mult float64
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1e3
+	case 'M':
+		mult = 1e6
+	case 'G':
+		mult = 1e9
+	case 'T':
+		mult = 1e12
+	}
+	if mult != 0 {
+		f, err := strconv.ParseFloat(strings.Replace(s[:len(s)-1], ",", ".", 1), 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(f * mult), nil
+	}
+	s = strings.Replace(s, ",", "", -1)
+	s = strings.Replace(s, ".", "", -1)
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// snapshotMeta is stored as a JSON file next to each snapshot in the data
+// directory.
+type snapshotMeta struct {
+	Stats  *rsyncStats `json:",omitempty"`
+	Pinned bool        `json:",omitempty"`
+}
+
+// metaName returns the file name of the metadata file for the receiver
+// snapshot. Since the snapshot directory is renamed on each state transition,
+// only the start time is used.
+func (s *snapshot) metaName() string {
+	config := currentConfig()
+	return filepath.Join(config.repository, dataSubdir, fmt.Sprintf("%d.json", s.startTime.Unix()))
+}
+
+// readMeta returns the metadata stored for the receiver snapshot. If there is
+// none, an empty snapshotMeta is returned.
+func (s *snapshot) readMeta() (*snapshotMeta, error) {
+	m := new(snapshotMeta)
+	b, err := ioutil.ReadFile(s.metaName())
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, m)
+	return m, err
+}
+
+// writeMeta stores m as the metadata for the receiver snapshot.
+func (s *snapshot) writeMeta(m *snapshotMeta) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaName(), b, 0644)
+}
+
+// pinned returns true if the receiver snapshot is protected from pruning and
+// purging. If the metadata can not be read, the snapshot is considered pinned
+// to be on the safe side.
+func (s *snapshot) pinned() bool {
+	m, err := s.readMeta()
+	if err != nil {
+		log.Printf("could not read metadata of %s, considering it pinned: %s", s.Name(), err)
+		return true
+	}
+	return m.Pinned
+}
+
+// setPinned changes the pinned flag of the receiver snapshot.
+func (s *snapshot) setPinned(pinned bool) error {
+	m, err := s.readMeta()
+	if err != nil {
+		return err
+	}
+	m.Pinned = pinned
+	return s.writeMeta(m)
+}
+
+// unpinned returns a new list without the pinned snapshots.
+func (sl snapshotList) unpinned() snapshotList {
+	slNew := make(snapshotList, 0, len(sl))
+	for _, sn := range sl {
+		if !sn.pinned() {
+			slNew = append(slNew, sn)
+		}
+	}
+	return slNew
+}
+
+// humanBytes formats a byte count using binary prefixes.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// String returns a short summary suitable for log and list output.
+func (st *rsyncStats) String() string {
+	return fmt.Sprintf("%d/%d files, %s/%s transferred in %s",
+		st.TransferredFiles, st.Files,
+		humanBytes(st.TransferredSize), humanBytes(st.TotalSize),
+		time.Duration(st.Duration*float64(time.Second)).Round(time.Second))
+}
@@ -0,0 +1,95 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rsyncStatsOutput = `sending incremental file list
+somedir/
+somedir/somefile
+
+Number of files: 1,234 (reg: 1,000, dir: 234)
+Number of created files: 12 (reg: 10, dir: 2)
+Number of deleted files: 3 (reg: 3)
+Number of regular files transferred: 17
+Total file size: 12,345,678 bytes
+Total transferred file size: 45,678 bytes
+Literal data: 40,000 bytes
+Matched data: 5,678 bytes
+File list size: 0
+File list generation time: 0.001 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 46,000
+Total bytes received: 1.23K
+
+sent 46,000 bytes  received 1,230 bytes  94,460.00 bytes/sec
+total size is 12,345,678  speedup is 261.40`
+
+func TestRsyncStatsParseLine(t *testing.T) {
+	st := new(rsyncStats)
+	for _, line := range strings.Split(rsyncStatsOutput, "\n") {
+		st.parseLine(line)
+	}
+	wanted := &rsyncStats{
+		Files:            1234,
+		CreatedFiles:     12,
+		DeletedFiles:     3,
+		TransferredFiles: 17,
+		TotalSize:        12345678,
+		TransferredSize:  45678,
+		LiteralData:      40000,
+		MatchedData:      5678,
+		BytesSent:        46000,
+		BytesReceived:    1230,
+	}
+	if !reflect.DeepEqual(st, wanted) {
+		t.Errorf("wanted %+v, got %+v", wanted, st)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                     "0B",
+		1023:                  "1023B",
+		1024:                  "1.0KiB",
+		1536:                  "1.5KiB",
+		5 * GiB:               "5.0GiB",
+		3 * 1024 * 1024 * GiB: "3.0PiB",
+	}
+	for n, wanted := range tests {
+		if got := humanBytes(n); got != wanted {
+			t.Errorf("humanBytes(%d) = %s, wanted %s", n, got, wanted)
+		}
+	}
+}
+
+func TestSnapshotMeta(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	sn := newSnapshot(time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete)
+	m, err := sn.readMeta()
+	if err != nil || m.Stats != nil {
+		t.Errorf("readMeta() without metadata file gave %v, %v", m, err)
+	}
+	err = sn.writeMeta(&snapshotMeta{Stats: &rsyncStats{Files: 3, ExitCode: 24}})
+	if err != nil {
+		t.Errorf("writeMeta() gave error %v", err)
+	}
+	// the metadata has to survive state transitions
+	sn.transObsolete()
+	m, err = sn.readMeta()
+	if err != nil || m.Stats == nil || m.Stats.Files != 3 || m.Stats.ExitCode != 24 {
+		t.Errorf("readMeta() gave %v, %v", m, err)
+	}
+	sn.purge()
+	if _, err := os.Stat(sn.metaName()); !os.IsNotExist(err) {
+		t.Errorf("metadata file %s was not removed by purge()", sn.metaName())
+	}
+}
@@ -0,0 +1,241 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Prometheus metrics for the run subcommand
+// The text exposition format is simple enough to be written by hand, so there
+// is no need for the prometheus client library.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricsRegistry struct {
+	mu               sync.Mutex
+	lastSuccess      time.Time
+	lastDuration     time.Duration
+	snapshotsCreated uint64
+	totalDuration    time.Duration
+	rsyncExitCodes   map[int]uint64
+	purgeCount       uint64
+	purgeDuration    time.Duration
+	obsoleteQueue    chan *snapshot
+	notifications    uint64
+	notifyErrors     uint64
+	overdue          bool
+}
+
+// metrics collects the events of the running daemon.
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		rsyncExitCodes: make(map[int]uint64),
+	}
+}
+
+// snapshotCreated records a successfully finished snapshot.
+func (m *metricsRegistry) snapshotCreated(sn *snapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSuccess = sn.endTime
+	m.lastDuration = sn.endTime.Sub(sn.startTime)
+	m.snapshotsCreated++
+	m.totalDuration += m.lastDuration
+}
+
+// rsyncExited records the exit code of an rsync run.
+func (m *metricsRegistry) rsyncExited(code int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rsyncExitCodes[code]++
+}
+
+// purged records the deletion of a snapshot and how long it took.
+func (m *metricsRegistry) purged(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purgeCount++
+	m.purgeDuration += d
+}
+
+// notificationSent records the result of sending a notification.
+func (m *metricsRegistry) notificationSent(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications++
+	if err != nil {
+		m.notifyErrors++
+	}
+}
+
+// setOverdue records if the repository is overdue.
+func (m *metricsRegistry) setOverdue(overdue bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overdue = overdue
+}
+
+// metricsCounters is a copy of the counters of a metricsRegistry at one
+// point in time.
+type metricsCounters struct {
+	snapshotsCreated uint64
+	totalDuration    time.Duration
+	rsyncExitCodes   map[int]uint64
+	purgeCount       uint64
+}
+
+// counters returns the current values of the counters.
+func (m *metricsRegistry) counters() metricsCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := metricsCounters{
+		snapshotsCreated: m.snapshotsCreated,
+		totalDuration:    m.totalDuration,
+		rsyncExitCodes:   make(map[int]uint64, len(m.rsyncExitCodes)),
+		purgeCount:       m.purgeCount,
+	}
+	for code, n := range m.rsyncExitCodes {
+		c.rsyncExitCodes[code] = n
+	}
+	return c
+}
+
+// rsyncExitDescription returns a text for the given rsync exit code.
+func rsyncExitDescription(code int) string {
+	if code == 0 {
+		return "Success"
+	}
+	if s, ok := rsyncIgnoredErrors[code]; ok {
+		return s
+	}
+	return "<unknown>"
+}
+
+// writeMetric writes one metric in the prometheus text format. labels must
+// already be formatted, like `code="24"`.
+func writeMetric(w io.Writer, name, typ, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		if labels == "" {
+			fmt.Fprintf(w, "%s %v\n", name, values[labels])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, labels, values[labels])
+		}
+	}
+}
+
+// ServeHTTP writes all metrics. Values that are not events, like the number of
+// snapshots or the free space, are determined at the time of the request.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	var lastSuccess float64
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.Unix())
+	}
+	writeMetric(w, "snaprd_last_success_timestamp_seconds", "gauge",
+		"End time of the last successfully created snapshot.",
+		map[string]float64{"": lastSuccess})
+	writeMetric(w, "snaprd_last_snapshot_duration_seconds", "gauge",
+		"Duration of the last successfully created snapshot.",
+		map[string]float64{"": m.lastDuration.Seconds()})
+	writeMetric(w, "snaprd_snapshots_created_total", "counter",
+		"Number of snapshots created since start.",
+		map[string]float64{"": float64(m.snapshotsCreated)})
+	codes := make(map[string]float64)
+	for code, n := range m.rsyncExitCodes {
+		codes[fmt.Sprintf("code=\"%d\",description=%q", code, rsyncExitDescription(code))] = float64(n)
+	}
+	writeMetric(w, "snaprd_rsync_exit_total", "counter",
+		"Number of rsync runs by exit code.", codes)
+	writeMetric(w, "snaprd_purges_total", "counter",
+		"Number of purged snapshots since start.",
+		map[string]float64{"": float64(m.purgeCount)})
+	writeMetric(w, "snaprd_purge_duration_seconds_total", "counter",
+		"Time spent purging snapshots since start.",
+		map[string]float64{"": m.purgeDuration.Seconds()})
+	writeMetric(w, "snaprd_notifications_total", "counter",
+		"Number of notifications sent since start.",
+		map[string]float64{"": float64(m.notifications)})
+	writeMetric(w, "snaprd_notification_errors_total", "counter",
+		"Number of notifications that could not be delivered.",
+		map[string]float64{"": float64(m.notifyErrors)})
+	var overdue float64
+	if m.overdue {
+		overdue = 1
+	}
+	writeMetric(w, "snaprd_overdue", "gauge",
+		"1 if no snapshot has been completed within -overdueFactor intervals.",
+		map[string]float64{"": overdue})
+	if m.obsoleteQueue != nil {
+		writeMetric(w, "snaprd_obsolete_queue_length", "gauge",
+			"Number of snapshots waiting to be purged.",
+			map[string]float64{"": float64(len(m.obsoleteQueue))})
+	}
+	m.mu.Unlock()
+
+	states := make(map[string]float64)
+	for _, st := range []snapshotState{stateIncomplete, stateComplete, stateObsolete, statePurging, statePartial} {
+		states[fmt.Sprintf("state=\"%s\"", strings.ToLower(st.String()))] = 0
+	}
+	snapshots, err := findSnapshots(new(realClock))
+	if err != nil {
+		log.Println(err)
+	}
+	for _, sn := range snapshots {
+		states[fmt.Sprintf("state=\"%s\"", strings.ToLower(sn.state.String()))]++
+	}
+	writeMetric(w, "snaprd_snapshots", "gauge",
+		"Number of snapshots in the repository by state.", states)
+	sizeBytes, freeBytes, err := freeSpace(config.repository)
+	if err != nil {
+		log.Println("could not check free space:", err)
+	} else {
+		writeMetric(w, "snaprd_filesystem_size_bytes", "gauge",
+			"Size of the filesystem the repository is located on.",
+			map[string]float64{"": float64(sizeBytes)})
+		writeMetric(w, "snaprd_filesystem_free_bytes", "gauge",
+			"Free space on the filesystem the repository is located on.",
+			map[string]float64{"": float64(freeBytes)})
+	}
+	var spaceOk float64
+	if checkFreeSpace(config.repository, config.MinPercSpace, config.MinGiBSpace) {
+		spaceOk = 1
+	}
+	writeMetric(w, "snaprd_free_space_ok", "gauge",
+		"Whether the free space constraints are satisfied.",
+		map[string]float64{"": spaceOk})
+}
+
+// serveMetrics starts the HTTP listener for the metrics endpoint and does not
+// return unless there is an error.
+func serveMetrics(addr string, obsoleteQueue chan *snapshot) {
+	sn := lastGoodFromDisk(new(realClock))
+	metrics.mu.Lock()
+	metrics.obsoleteQueue = obsoleteQueue
+	if sn != nil && metrics.lastSuccess.IsZero() {
+		metrics.lastSuccess = sn.endTime
+		metrics.lastDuration = sn.endTime.Sub(sn.startTime)
+	}
+	metrics.mu.Unlock()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Printf("serving metrics on http://%s/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	log.Println("metrics listener failed:", err)
+}
@@ -0,0 +1,51 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	mockConfig()
+	mockRepositoryDangling()
+	defer os.RemoveAll(config.repository)
+	m := newMetricsRegistry()
+	m.obsoleteQueue = make(chan *snapshot, 10)
+	m.obsoleteQueue <- newSnapshot(time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete)
+	m.snapshotCreated(newSnapshot(time.Unix(1400337721, 0), time.Unix(1400337751, 0), stateComplete))
+	m.rsyncExited(0)
+	m.rsyncExited(24)
+	m.rsyncExited(24)
+	m.purged(time.Second * 3)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(rec.Body)
+	out := string(b)
+	for _, want := range []string{
+		"snaprd_last_success_timestamp_seconds 1.400337751e+09\n",
+		"snaprd_last_snapshot_duration_seconds 30\n",
+		"snaprd_snapshots_created_total 1\n",
+		"snaprd_rsync_exit_total{code=\"0\",description=\"Success\"} 1\n",
+		"snaprd_rsync_exit_total{code=\"24\",description=\"Partial transfer due to vanished source files\"} 2\n",
+		"snaprd_purges_total 1\n",
+		"snaprd_purge_duration_seconds_total 3\n",
+		"snaprd_obsolete_queue_length 1\n",
+		"snaprd_snapshots{state=\"complete\"} 7\n",
+		"snaprd_snapshots{state=\"incomplete\"} 0\n",
+		"snaprd_snapshots{state=\"obsolete\"} 1\n",
+		"snaprd_snapshots{state=\"purging\"} 1\n",
+		"snaprd_free_space_ok 1\n",
+		"# TYPE snaprd_filesystem_free_bytes gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output does not contain %q", want)
+		}
+	}
+}
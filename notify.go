@@ -0,0 +1,148 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Dispatch of notifications to mail and webhook backends
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logBuffer keeps the latest log lines for notifications.
+var logBuffer = newRingIO(os.Stderr, 25, 100)
+
+// webhookBackoff is the time to wait before the first retry of a webhook. It
+// doubles with every further retry.
+var webhookBackoff = time.Second * 2
+
+// webhookURLEnv is used to hand the webhook URL, which often contains a
+// token, from the jobs supervisor to the jobs.
+const webhookURLEnv = "SNAPRD_WEBHOOK_URL"
+
+// inheritedWebhookURL is the webhook URL handed over by the supervisor.
+var inheritedWebhookURL = takeEnv(webhookURLEnv)
+
+// webhookPayload is the JSON document that is posted to -webhookURL.
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Origin      string    `json:"origin"`
+	Repository  string    `json:"repository"`
+	Message     string    `json:"message"`
+	ExitCode    int       `json:"exitCode"`
+	RsyncExit   int       `json:"rsyncExit,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Log         []string  `json:"log"`
+}
+
+// recentLog returns the lines in logBuffer.
+func recentLog() []string {
+	lines := []string{}
+	for _, l := range logBuffer.GetAll() {
+		if len(l) > 0 {
+			lines = append(lines, strings.TrimRight(string(l), "\n"))
+		}
+	}
+	return lines
+}
+
+// newWebhookPayload returns a payload for event, filled with the current
+// settings and the recent log.
+func newWebhookPayload(event, msg string) *webhookPayload {
+	config := currentConfig()
+	return &webhookPayload{
+		Event:      event,
+		Time:       time.Now(),
+		Origin:     config.Origin,
+		Repository: config.repository,
+		Message:    msg,
+		Log:        recentLog(),
+	}
+}
+
+// postWebhook sends p to the configured webhook URL. Failed attempts are
+// repeated -webhookRetries times with increasing waiting time.
+func postWebhook(p *webhookPayload) error {
+	config := currentConfig()
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: config.WebhookTimeout}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(config.WebhookURL, "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		if attempt >= config.WebhookRetries {
+			return err
+		}
+		log.Printf("webhook failed (%s), retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sendWebhook posts p and records the result in the metrics.
+func sendWebhook(p *webhookPayload) error {
+	err := postWebhook(p)
+	metrics.notificationSent(err)
+	if err != nil {
+		log.Printf("could not send %s notification to webhook: %s", p.Event, err)
+		return err
+	}
+	debugf("sending %s notification to webhook done", p.Event)
+	return nil
+}
+
+// notifyFailure reports that snaprd is exiting with an error.
+func notifyFailure(exitCode int) {
+	config := currentConfig()
+	if config.Notify != "" {
+		FailureMail(exitCode, logBuffer)
+	}
+	if config.WebhookURL != "" {
+		p := newWebhookPayload("failure", fmt.Sprintf("snaprd exited with return value %d", exitCode))
+		p.ExitCode = exitCode
+		sendWebhook(p)
+	}
+}
+
+// notifyRsyncIssue reports a non-fatal rsync error. It does not block.
+func notifyRsyncIssue(rsyncError error, rsyncErrorCode int) {
+	config := currentConfig()
+	if config.Notify != "" {
+		RsyncIssueMail(rsyncError, rsyncErrorCode)
+	}
+	if config.WebhookURL != "" {
+		p := newWebhookPayload("rsync_issue", fmt.Sprintf("rsync finished with error: %s", rsyncError))
+		p.RsyncExit = rsyncErrorCode
+		p.Description = rsyncExitDescription(rsyncErrorCode)
+		go sendWebhook(p)
+	}
+}
+
+// notifyEvent sends a notification about event to all configured backends.
+// It does not block.
+func notifyEvent(event, subject, msg string) {
+	config := currentConfig()
+	if config.Notify != "" {
+		go SendMail(config.Notify, subject, msg)
+	}
+	if config.WebhookURL != "" {
+		go sendWebhook(newWebhookPayload(event, msg))
+	}
+}
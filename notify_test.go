@@ -0,0 +1,95 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// webhookStandIn returns a server that fails the first failures requests and
+// records the payloads of all successful ones.
+func webhookStandIn(failures int) (*httptest.Server, chan webhookPayload) {
+	received := make(chan webhookPayload, 10)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var p webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- p
+	}))
+	return ts, received
+}
+
+func mockWebhookConfig(url string) {
+	mockConfig()
+	config.Origin = "fileserver:/export/projects"
+	config.WebhookURL = url
+	config.WebhookTimeout = time.Second
+	config.WebhookRetries = 2
+	webhookBackoff = time.Millisecond
+	metrics = newMetricsRegistry()
+}
+
+func TestWebhookRsyncIssue(t *testing.T) {
+	ts, received := webhookStandIn(2)
+	defer ts.Close()
+	mockWebhookConfig(ts.URL)
+	defer os.RemoveAll(config.repository)
+	logBuffer = newRingIO(os.Stderr, 25, 100)
+	log.SetOutput(logBuffer)
+	log.Print("something happened")
+	notifyRsyncIssue(errors.New("exit status 23"), 23)
+	var p webhookPayload
+	select {
+	case p = <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("no webhook received")
+	}
+	if p.Event != "rsync_issue" || p.RsyncExit != 23 ||
+		p.Description != rsyncIgnoredErrors[23] ||
+		p.Origin != config.Origin || p.Repository != config.repository {
+		t.Errorf("webhook payload %+v does not describe the rsync issue", p)
+	}
+	if len(p.Log) != 1 {
+		t.Errorf("webhook payload contains log %q, wanted one line", p.Log)
+	}
+	// the notification goroutine must not outlive the test, it still
+	// records the result in the metrics
+	for i := 0; i < 500; i++ {
+		metrics.mu.Lock()
+		n := metrics.notifications
+		metrics.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	ts, _ := webhookStandIn(100)
+	defer ts.Close()
+	mockWebhookConfig(ts.URL)
+	defer os.RemoveAll(config.repository)
+	err := sendWebhook(newWebhookPayload("failure", "test"))
+	if err == nil {
+		t.Errorf("sendWebhook() succeeded, but the server always fails")
+	}
+	if metrics.notifyErrors != 1 {
+		t.Errorf("metrics counted %d notification errors, wanted 1", metrics.notifyErrors)
+	}
+}
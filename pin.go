@@ -0,0 +1,39 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Protecting individual snapshots from pruning
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// subcmdPin sets or removes the pinned flag of the snapshot selected on the
+// command line. Pinned snapshots are never marked obsolete or purged.
+func subcmdPin(pin bool, cl clock) error {
+	if cl == nil {
+		cl = new(realClock)
+	}
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		return err
+	}
+	sn, err := selectSnapshot(snapshots, config.pinSnapshot)
+	if err != nil {
+		return err
+	}
+	if pin && sn.state != stateComplete {
+		return fmt.Errorf("can not pin %s, only complete snapshots can be pinned", sn.Name())
+	}
+	err = sn.setPinned(pin)
+	if err != nil {
+		return err
+	}
+	if pin {
+		log.Printf("pinned %s", sn.Name())
+	} else {
+		log.Printf("unpinned %s", sn.Name())
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestPinnedNotPruned(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	mockConfig()
+	mockRepository()
+	schedules.addFromFile(config.SchedFile)
+	defer os.RemoveAll(config.repository)
+	cl := newSkewClock(startAt)
+	cl.forward(schedules[config.Schedule][0])
+	// without pinning, this one would be obsoleted, see TestPrune
+	config.pinSnapshot = "1400337706"
+	if err := subcmdPin(true, cl); err != nil {
+		t.Fatalf("subcmdPin() gave error %v", err)
+	}
+	c := make(chan *snapshot, 100)
+	prune(c, cl)
+	for len(c) > 0 {
+		if sn := <-c; sn.startTime.Unix() == 1400337706 {
+			t.Errorf("prune() obsoleted pinned snapshot %s", sn)
+		}
+	}
+	config.pinSnapshot = "1400337706-1400337707-complete"
+	if err := subcmdPin(false, cl); err != nil {
+		t.Fatalf("subcmdPin() gave error %v", err)
+	}
+	prune(c, cl)
+	assertSnapshotChanLen(t, c, 1)
+	assertSnapshotChanItem(t, c, "1400337706-1400337707 Obsolete")
+}
+
+func TestPinnedNotDangling(t *testing.T) {
+	mockConfig()
+	mockRepositoryDangling()
+	defer os.RemoveAll(config.repository)
+	cl := newSkewClock(startAt)
+	config.pinSnapshot = "1400337711-1400337712-obsolete"
+	if err := subcmdPin(true, cl); err == nil {
+		t.Errorf("subcmdPin() did not fail for an obsolete snapshot")
+	}
+	sl, _ := findSnapshots(cl)
+	sn, _ := selectSnapshot(sl, config.pinSnapshot)
+	// snapshot got pinned before it was marked obsolete
+	sn.setPinned(true)
+	sl = findDangling(cl)
+	if len(sl) != 1 || sl[0].String() != "1400337651-1400337652 Purging" {
+		t.Errorf("findDangling() found %v, pinned snapshot should be left out", sl)
+	}
+}
@@ -0,0 +1,117 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// What to do about the different exit codes of rsync
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type rsyncAction int
+
+const (
+	// rsyncAccept marks the snapshot as complete
+	rsyncAccept rsyncAction = iota
+	// rsyncRetry runs rsync again into the same incomplete snapshot
+	rsyncRetry
+	// rsyncFail stops snaprd
+	rsyncFail
+	// rsyncPartial marks the snapshot as partial
+	rsyncPartial
+)
+
+var rsyncActionNames = map[rsyncAction]string{
+	rsyncAccept:  "accept",
+	rsyncRetry:   "retry",
+	rsyncFail:    "fail",
+	rsyncPartial: "partial",
+}
+
+func (a rsyncAction) String() string {
+	return rsyncActionNames[a]
+}
+
+// defaultRsyncPolicy is used for all exit codes that are not set by
+// -rsyncPolicy. Exit codes not listed here fail. Errors of the connection are
+// retried, because the transfer has most likely been cut off. Snapshots with
+// files that could not be transferred are kept as partial.
+var defaultRsyncPolicy = map[int]rsyncAction{
+	0:  rsyncAccept,
+	6:  rsyncAccept,
+	10: rsyncRetry,
+	11: rsyncAccept,
+	12: rsyncRetry,
+	13: rsyncAccept,
+	14: rsyncAccept,
+	20: rsyncAccept,
+	21: rsyncAccept,
+	22: rsyncAccept,
+	23: rsyncPartial,
+	24: rsyncAccept,
+	25: rsyncAccept,
+	30: rsyncRetry,
+	35: rsyncRetry,
+}
+
+// parseRsyncPolicy reads a policy like "23:retry,24:accept". Exit codes that
+// are not given keep their default action.
+func parseRsyncPolicy(s string) (map[int]rsyncAction, error) {
+	policy := make(map[int]rsyncAction, len(defaultRsyncPolicy))
+	for code, a := range defaultRsyncPolicy {
+		policy[code] = a
+	}
+	if s == "" {
+		return policy, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(e), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed rsync policy entry: %s", e)
+		}
+		code, err := strconv.Atoi(kv[0])
+		if err != nil || code <= 0 {
+			return nil, fmt.Errorf("invalid rsync exit code in policy: %s", kv[0])
+		}
+		found := false
+		for a, name := range rsyncActionNames {
+			if name == kv[1] {
+				policy[code] = a
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid rsync policy action for code %d: %s", code, kv[1])
+		}
+	}
+	return policy, nil
+}
+
+// formatRsyncPolicy returns the policy in the format parseRsyncPolicy reads.
+func formatRsyncPolicy(policy map[int]rsyncAction) string {
+	var codes []int
+	for code := range policy {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	a := make([]string, 0, len(codes))
+	for _, code := range codes {
+		a = append(a, fmt.Sprintf("%d:%s", code, policy[code]))
+	}
+	return strings.Join(a, ",")
+}
+
+// rsyncPolicyFor returns the action for the given rsync exit code.
+func rsyncPolicyFor(code int) rsyncAction {
+	policy := config.rsyncPolicy
+	if policy == nil {
+		policy = defaultRsyncPolicy
+	}
+	if a, ok := policy[code]; ok {
+		return a
+	}
+	return rsyncFail
+}
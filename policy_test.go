@@ -0,0 +1,56 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRsyncPolicy(t *testing.T) {
+	policy, err := parseRsyncPolicy("23:retry, 24:fail,99:accept")
+	if err != nil {
+		t.Fatalf("parseRsyncPolicy() returned an error: %v", err)
+	}
+	for code, wanted := range map[int]rsyncAction{
+		0:  rsyncAccept,
+		23: rsyncRetry,
+		24: rsyncFail,
+		99: rsyncAccept,
+		30: rsyncRetry,
+		25: rsyncAccept,
+	} {
+		if policy[code] != wanted {
+			t.Errorf("policy for %d is %s, wanted %s", code, policy[code], wanted)
+		}
+	}
+	// the defaults must not be changed
+	if defaultRsyncPolicy[24] != rsyncAccept {
+		t.Errorf("parseRsyncPolicy() changed the default policy")
+	}
+	for _, s := range []string{"23", "x:retry", "0:fail", "23:ignore", "23:retry,"} {
+		if _, err := parseRsyncPolicy(s); err == nil {
+			t.Errorf("parseRsyncPolicy(%q) did not fail, but it should", s)
+		}
+	}
+}
+
+func TestFormatRsyncPolicy(t *testing.T) {
+	got := formatRsyncPolicy(map[int]rsyncAction{30: rsyncRetry, 23: rsyncFail, 0: rsyncAccept})
+	if wanted := "0:accept,23:fail,30:retry"; got != wanted {
+		t.Errorf("formatRsyncPolicy() = %q, wanted %q", got, wanted)
+	}
+}
+
+func TestRsyncPolicyFor(t *testing.T) {
+	mockConfig()
+	if a := rsyncPolicyFor(30); a != rsyncRetry {
+		t.Errorf("rsyncPolicyFor(30) without a policy is %s, wanted retry", a)
+	}
+	if a := rsyncPolicyFor(3); a != rsyncFail {
+		t.Errorf("rsyncPolicyFor(3) is %s, wanted fail", a)
+	}
+	config.rsyncPolicy, _ = parseRsyncPolicy("3:accept")
+	if a := rsyncPolicyFor(3); a != rsyncAccept {
+		t.Errorf("rsyncPolicyFor(3) is %s, wanted accept", a)
+	}
+}
@@ -7,56 +7,165 @@
 package main
 
 import (
+	"fmt"
 	"log"
 )
 
+// pruneDecision tells which snapshot should be marked obsolete and why.
+type pruneDecision struct {
+	sn       *snapshot
+	interval int
+	reason   string
+}
+
+// intervalOf returns the number of the interval sn falls into.
+func intervalOf(sn *snapshot, intervals intervalList, cl clock) int {
+	for n := 0; n < len(intervals)-1; n++ {
+		if len(snapshotList{sn}.interval(intervals, n, cl)) > 0 {
+			return n
+		}
+	}
+	return len(intervals) - 2
+}
+
+// sieve applies the schedule given by intervals and maxKeep to the snapshots
+// in sl and returns those that should be marked obsolete, in the order they
+// have been found. The snapshots in sl are not modified, so this can be used
+// to preview the effect of a schedule. Snapshots for which the optional
+// function pinned returns true are kept in addition to the schedule and are
+// not taken into account at all. Partial snapshots are obsoleted as soon as
+// there is a newer complete snapshot, until then they are sieved like complete
+// ones, so they can not pile up. If al is not nil, only the first
+// snapshot of each calendar period of an interval is kept, instead of
+// snapshots that are far enough apart.
+func sieve(sl snapshotList, intervals intervalList, maxKeep int, al *alignment, pinned func(*snapshot) bool, cl clock) []pruneDecision {
+	if len(sl) < 2 {
+		return nil
+	}
+	// work on copies, so the state can be changed without affecting sl
+	work := make(snapshotList, 0, len(sl))
+	orig := make(map[*snapshot]*snapshot, len(sl))
+	for _, sn := range sl {
+		if pinned != nil && pinned(sn) {
+			debugf("not pruning pinned snapshot %s", sn)
+			continue
+		}
+		c := *sn
+		work = append(work, &c)
+		orig[&c] = sn
+	}
+	var decisions []pruneDecision
+	// partial snapshots are only useful until there is a newer complete one
+	if latest := work.state(stateComplete, none).lastGood(); latest != nil {
+		for _, sn := range work.state(statePartial, none) {
+			if sn.startTime.Before(latest.startTime) {
+				sn.state = stateObsolete
+				decisions = append(decisions, pruneDecision{orig[sn], intervalOf(sn, intervals, cl),
+					fmt.Sprintf("partial snapshot superseded by complete snapshot %s", latest.Name())})
+			}
+		}
+	}
+	var sieveAll func()
+	sieveAll = func() {
+		// interval 0 does not need pruning, start with 1
+		for i := len(intervals) - 2; i > 0; i-- {
+			iv := work.interval(intervals, i, cl).state(stateComplete+statePartial, stateObsolete)
+			pruneAgain := false
+			if len(iv) > 2 {
+				// prune highest interval by maximum number
+				if (i == len(intervals)-2) &&
+					(len(iv) > maxKeep) &&
+					(maxKeep != 0) {
+					debugf("%d snapshots in oldest interval", len(iv))
+					iv[0].state = stateObsolete
+					decisions = append(decisions, pruneDecision{orig[iv[0]], i,
+						fmt.Sprintf("%d snapshots in oldest interval exceed maxKeep %d", len(iv), maxKeep)})
+					pruneAgain = true
+				}
+				// regularly prune by sieving
+				youngest := len(iv) - 1
+				secondYoungest := youngest - 1
+				dist := iv[youngest].startTime.Sub(iv[secondYoungest].startTime)
+				if al != nil {
+					if al.samePeriod(iv[youngest].startTime, iv[secondYoungest].startTime, intervals[i]) {
+						start, _ := al.period(iv[youngest].startTime, intervals[i])
+						iv[youngest].state = stateObsolete
+						decisions = append(decisions, pruneDecision{orig[iv[youngest]], i,
+							fmt.Sprintf("%s period starting %s already has a snapshot", intervals[i], start.Format("2006-01-02 Monday 15:04:05"))})
+						pruneAgain = true
+					}
+				} else if dist.Seconds() < intervals[i].Seconds() {
+					iv[youngest].state = stateObsolete
+					decisions = append(decisions, pruneDecision{orig[iv[youngest]], i,
+						fmt.Sprintf("distance %s to previous snapshot is less than %s", dist, intervals[i])})
+					pruneAgain = true
+				}
+				if pruneAgain {
+					sieveAll()
+				}
+			}
+		}
+	}
+	sieveAll()
+	return decisions
+}
+
 // Sieves snapshots according to schedule and marks them as obsolete. Also,
 // enqueue them in the buffered channel q for later reuse or deletion.
 func prune(q chan *snapshot, cl clock) {
-	intervals := schedules[config.Schedule]
-	// interval 0 does not need pruning, start with 1
-	for i := len(intervals) - 2; i > 0; i-- {
-		snapshots, err := findSnapshots(cl)
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(snapshots) < 2 {
+		log.Println("less than 2 snapshots found, not pruning")
+		return
+	}
+	for _, d := range sieve(snapshots, schedules[config.Schedule], config.MaxKeep, config.alignment(), (*snapshot).pinned, cl) {
+		log.Printf("mark as obsolete: %s (interval %d: %s)", d.sn.Name(), d.interval, d.reason)
+		err := d.sn.transObsolete()
 		if err != nil {
-			log.Println(err)
-			return
+			log.Printf("could not transition snapshot: %s", err)
 		}
-		if len(snapshots) < 2 {
-			log.Println("less than 2 snapshots found, not pruning")
-			return
+		q <- d.sn
+	}
+}
+
+// subcmdPrune applies the schedule to the repository once. With -dryRun it
+// only shows which snapshots would be marked obsolete.
+func subcmdPrune(cl clock) error {
+	if cl == nil {
+		cl = new(realClock)
+	}
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		return err
+	}
+	if config.pruneDryRun {
+		// only these can be marked obsolete
+		candidates := snapshots.state(stateComplete+statePartial, none)
+		decisions := sieve(candidates, schedules[config.Schedule], config.MaxKeep, config.alignment(), (*snapshot).pinned, cl)
+		for _, d := range decisions {
+			fmt.Printf("would mark as obsolete: %s \"%s\" (interval %d: %s)\n",
+				d.sn.startTime.Format("2006-01-02 Monday 15:04:05"), d.sn.Name(), d.interval, d.reason)
 		}
-		iv := snapshots.interval(intervals, i, cl).state(stateComplete, stateObsolete)
-		pruneAgain := false
-		if len(iv) > 2 {
-			// prune highest interval by maximum number
-			if (i == len(intervals)-2) &&
-				(len(iv) > config.MaxKeep) &&
-				(config.MaxKeep != 0) {
-				debugf("%d snapshots in oldest interval", len(iv))
-				log.Printf("mark oldest as obsolete: %s", iv[0])
-				err := iv[0].transObsolete()
-				if err != nil {
-					log.Printf("could not transition snapshot: %s", err)
-				}
-				q <- iv[0]
-				pruneAgain = true
-			}
-			// regularly prune by sieving
-			youngest := len(iv) - 1
-			secondYoungest := youngest - 1
-			dist := iv[youngest].startTime.Sub(iv[secondYoungest].startTime)
-			if dist.Seconds() < intervals[i].Seconds() {
-				log.Printf("mark as obsolete: %s", iv[youngest].Name())
-				err := iv[youngest].transObsolete()
-				if err != nil {
-					log.Printf("could not transition snapshot: %s", err)
-				}
-				q <- iv[youngest]
-				pruneAgain = true
-			}
-			if pruneAgain {
-				prune(q, cl)
-			}
+		fmt.Printf("%d of %d snapshots would be marked as obsolete\n", len(decisions), len(candidates))
+		return nil
+	}
+	rl := newRepoLocker(config.repository)
+	err = rl.Lock()
+	if err != nil {
+		return err
+	}
+	defer rl.Unlock()
+	q := make(chan *snapshot, len(snapshots))
+	prune(q, cl)
+	close(q)
+	for sn := range q {
+		if !config.NoPurge && !sn.pinned() {
+			sn.purge()
 		}
 	}
+	return nil
 }
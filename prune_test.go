@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -108,3 +109,109 @@ func TestPrune(t *testing.T) {
 		}
 	}
 }
+
+func Example_subcmdPruneDryRun() {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	config.pruneDryRun = true
+	cl := newSkewClock(startAt)
+	cl.forward(schedules[config.Schedule][0] * 11)
+	subcmdPrune(cl)
+	// Output:
+	// would mark as obsolete: 2014-05-17 Saturday 16:41:56 "1400337716-1400337717-complete" (interval 2: distance 5s to previous snapshot is less than 40s)
+	// would mark as obsolete: 2014-05-17 Saturday 16:41:51 "1400337711-1400337712-complete" (interval 2: distance 5s to previous snapshot is less than 40s)
+	// would mark as obsolete: 2014-05-17 Saturday 16:41:46 "1400337706-1400337707-complete" (interval 2: distance 15s to previous snapshot is less than 40s)
+	// would mark as obsolete: 2014-05-17 Saturday 16:41:31 "1400337691-1400337692-complete" (interval 2: distance 20s to previous snapshot is less than 40s)
+	// 4 of 9 snapshots would be marked as obsolete
+}
+
+func Example_subcmdPruneDryRunPartial() {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	for _, s := range []string{"1400337531-1400337532-complete", "1400337536-1400337537-partial", "1400337541-1400337542-partial", "1400337546-1400337547-complete"} {
+		os.MkdirAll(filepath.Join(config.repository, dataSubdir, s), 0777)
+	}
+	schedules.addFromFile(config.SchedFile)
+	config.pruneDryRun = true
+	cl := newSkewClock(1400337548)
+	subcmdPrune(cl)
+	// Output:
+	// would mark as obsolete: 2014-05-17 Saturday 16:38:56 "1400337536-1400337537-partial" (interval 0: partial snapshot superseded by complete snapshot 1400337546-1400337547-complete)
+	// would mark as obsolete: 2014-05-17 Saturday 16:39:01 "1400337541-1400337542-partial" (interval 0: partial snapshot superseded by complete snapshot 1400337546-1400337547-complete)
+	// 2 of 4 snapshots would be marked as obsolete
+}
+
+func TestSievePartialBounded(t *testing.T) {
+	// rsync returns 23 every time, so there are only partial snapshots
+	intervals := intervalList{time.Second * 5, time.Second * 20, time.Second * 140, time.Second * 280, long}
+	cl := newVirtualClock(startAt)
+	var sl snapshotList
+	peak := 0
+	for i := 0; i < 1000; i++ {
+		sl = append(sl, newSnapshot(cl.Now(), cl.Now().Add(time.Second), statePartial))
+		cl.forward(time.Second)
+		obsolete := make(map[*snapshot]bool)
+		for _, d := range sieve(sl, intervals, 2, nil, nil, cl) {
+			obsolete[d.sn] = true
+		}
+		kept := sl[:0]
+		for _, sn := range sl {
+			if !obsolete[sn] {
+				kept = append(kept, sn)
+			}
+		}
+		sl = kept
+		if len(sl) > peak {
+			peak = len(sl)
+		}
+		cl.forward(intervals[0] - time.Second)
+	}
+	// the same as with complete snapshots
+	if wanted := simulate(intervals, 2, intervals[0]*1000, 0, 0).peakTotal; peak > wanted {
+		t.Errorf("%d partial snapshots kept, wanted at most %d", peak, wanted)
+	}
+}
+
+func TestSieveDoesNotTouchDisk(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	schedules.addFromFile(config.SchedFile)
+	defer os.RemoveAll(config.repository)
+	cl := newSkewClock(startAt)
+	cl.forward(schedules[config.Schedule][0] * 11)
+	sl, _ := findSnapshots(cl)
+	decisions := sieve(sl, schedules[config.Schedule], config.MaxKeep, nil, nil, cl)
+	if len(decisions) != 4 {
+		t.Errorf("sieve() found %d snapshots to obsolete, wanted 4", len(decisions))
+	}
+	for _, sn := range sl {
+		if sn.state != stateComplete {
+			t.Errorf("sieve() changed state of %s", sn)
+		}
+	}
+	slAfter, _ := findSnapshots(cl)
+	if !reflect.DeepEqual(sl, slAfter) {
+		t.Errorf("sieve() changed the repository: %v, %v", sl, slAfter)
+	}
+}
+
+func TestSievePartial(t *testing.T) {
+	mockConfig()
+	schedules.addFromFile(config.SchedFile)
+	defer os.RemoveAll(config.repository)
+	cl := newVirtualClock(startAt)
+	sl := snapshotList{
+		{time.Unix(1400337691, 0), time.Unix(1400337692, 0), statePartial},
+		{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateComplete},
+		{time.Unix(1400337716, 0), time.Unix(1400337717, 0), statePartial},
+	}
+	decisions := sieve(sl, schedules[config.Schedule], config.MaxKeep, nil, nil, cl)
+	if len(decisions) != 1 || decisions[0].sn != sl[0] {
+		t.Errorf("sieve() decided %v, wanted to obsolete only the older partial snapshot", decisions)
+	}
+	if sl.lastGood() != sl[1] {
+		t.Errorf("lastGood() = %v, wanted the complete snapshot", sl.lastGood())
+	}
+}
@@ -0,0 +1,130 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Reloading the settings of a running daemon
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// settingsMu guards the global config and schedules, which are replaced when
+// the settings are reloaded. Code that may run beside the create loop takes a
+// snapshot with currentSettings instead of using the globals directly.
+var settingsMu sync.RWMutex
+
+// currentSettings returns the configuration and schedules in use.
+func currentSettings() (*Config, scheduleList) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return config, schedules
+}
+
+// currentConfig returns the configuration in use.
+func currentConfig() *Config {
+	c, _ := currentSettings()
+	return c
+}
+
+// reloadRunConfig reads the settings of the run subcommand again, from the
+// command line, the config file and the schedule file, and checks if they can
+// be used by the running daemon. The current settings are not changed.
+func reloadRunConfig() (*Config, scheduleList, error) {
+	config, schedules := currentSettings()
+	c, _, err := parseRunArgs(os.Args[2:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.repository != config.repository {
+		return nil, nil, fmt.Errorf("the repository can not be changed while running")
+	}
+	scheds := make(scheduleList, len(schedules))
+	for k, v := range schedules {
+		scheds[k] = v
+	}
+	if c.SchedFile != "" {
+		if err := scheds.addFromFile(c.SchedFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, ok := scheds[c.Schedule]; !ok {
+		return nil, nil, fmt.Errorf("no such schedule: %s", c.Schedule)
+	}
+	return c, scheds, nil
+}
+
+// configDiff returns a description of all settings that differ between a and
+// b. Values of settings that are not written to the settings cache are not
+// shown.
+func configDiff(a, b *Config) []string {
+	var diff []string
+	va := reflect.ValueOf(a).Elem()
+	vb := reflect.ValueOf(b).Elem()
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		x := va.Field(i).Interface()
+		y := vb.Field(i).Interface()
+		if reflect.DeepEqual(x, y) {
+			continue
+		}
+		if f.Tag.Get("json") == "-" {
+			diff = append(diff, fmt.Sprintf("%s changed", f.Name))
+		} else {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", f.Name, x, y))
+		}
+	}
+	return diff
+}
+
+// applyRunConfig replaces the global configuration and schedules, and wakes
+// up the goroutines that wait according to the old settings. It must only be
+// called from the create loop.
+func (d *daemon) applyRunConfig(c *Config, scheds scheduleList) {
+	diff := configDiff(config, c)
+	if len(diff) == 0 {
+		log.Println("settings reloaded, nothing changed")
+	}
+	for _, line := range diff {
+		log.Println("setting changed:", line)
+	}
+	c.jobArgs = config.jobArgs
+	settingsMu.Lock()
+	config = c
+	schedules = scheds
+	settingsMu.Unlock()
+	d.notifyReload()
+	err := c.WriteCache()
+	if err != nil {
+		log.Print("could not write settings cache file:", err)
+	}
+}
+
+// watchReload reloads the settings whenever SIGHUP is received. Valid
+// settings are applied by the create loop between two snapshots, invalid
+// ones are rejected and the daemon goes on with the current settings.
+func watchReload(d *daemon) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		log.Println("-> Reload")
+		c, scheds, err := reloadRunConfig()
+		if err != nil {
+			log.Println("reload rejected:", err)
+			continue
+		}
+		go func() {
+			d.safe <- func() { d.applyRunConfig(c, scheds) }
+		}()
+	}
+}
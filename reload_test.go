@@ -0,0 +1,120 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := &Config{Schedule: "longterm", MaxKeep: 2, SmtpPassword: "old", WebhookURL: "http://hook/old", verbose: true}
+	b := &Config{Schedule: "shortterm", MaxKeep: 2, SmtpPassword: "new", WebhookURL: "http://hook/new"}
+	b.RsyncOpts.Set("--one-file-system")
+	got := configDiff(a, b)
+	wanted := []string{
+		"RsyncOpts: [] -> [--one-file-system]",
+		"Schedule: longterm -> shortterm",
+		"SmtpPassword changed",
+		"WebhookURL changed",
+	}
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("configDiff() = %q, wanted %q", got, wanted)
+	}
+}
+
+func TestReloadRunConfig(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	defer func(args []string) { os.Args = args }(os.Args)
+	repository := config.repository
+	runArgs := func(args ...string) {
+		os.Args = append([]string{"snaprd", "run", "-repository=" + repository, "-schedFile=testdata/snaprd.schedules"}, args...)
+	}
+
+	runArgs("-schedule=testing", "-maxKeep=5")
+	c, scheds, err := reloadRunConfig()
+	if err != nil {
+		t.Fatalf("reloadRunConfig() failed: %v", err)
+	}
+	if c.Schedule != "testing" || c.MaxKeep != 5 || scheds["testing"] == nil {
+		t.Errorf("reloadRunConfig() = %+v", c)
+	}
+	old := schedules
+	defer func() { schedules = old }()
+	newDaemon().applyRunConfig(c, scheds)
+	if config != c {
+		t.Errorf("applyRunConfig() did not replace the settings")
+	}
+	config.MaxKeep = 0
+	config.ReadCache()
+	if config.MaxKeep != 5 {
+		t.Errorf("applyRunConfig() did not write the settings cache")
+	}
+
+	runArgs("-schedule=nonexistent")
+	if _, _, err := reloadRunConfig(); err == nil {
+		t.Errorf("reloadRunConfig() accepted an unknown schedule")
+	}
+	os.Args = []string{"snaprd", "run", "-repository=/somewhere/else"}
+	if _, _, err := reloadRunConfig(); err == nil {
+		t.Errorf("reloadRunConfig() accepted a different repository")
+	}
+}
+
+func TestApplyRunConfigConcurrent(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	old := schedules
+	defer func() { schedules = old }()
+	config.Schedule = "longterm"
+	cl := newSkewClock(startAt)
+	sn := newSnapshot(cl.Now(), cl.Now(), stateComplete)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			nextWait(sn, cl)
+			digestText(metricsCounters{}, metricsCounters{}, cl.Now(), cl)
+		}
+	}()
+	d := newDaemon()
+	for i := 0; i < 20; i++ {
+		c := *config
+		c.Schedule = []string{"shortterm", "longterm"}[i%2]
+		d.applyRunConfig(&c, schedules)
+	}
+	<-done
+}
+
+func TestReloadWakesTicker(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	old := schedules
+	defer func() { schedules = old }()
+	config.Schedule = "longterm"
+	d := newDaemon()
+	cl := new(realClock)
+	in := make(chan *snapshot)
+	out := make(chan *snapshot)
+	go lastGoodTicker(in, out, d.force, d.onReload(), cl)
+	// nothing on disk yet, so the first tick comes without waiting
+	<-out
+	in <- newSnapshot(cl.Now(), cl.Now(), stateComplete)
+	select {
+	case <-out:
+		t.Fatalf("lastGoodTicker() did not wait for the longterm schedule")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c := *config
+	c.Schedule = "fast"
+	scheds := scheduleList{"fast": {time.Nanosecond, long}}
+	d.applyRunConfig(&c, scheds)
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Errorf("lastGoodTicker() did not follow the reloaded schedule")
+	}
+}
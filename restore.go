@@ -0,0 +1,158 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Copying data back out of a snapshot
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var agoSelector = regexp.MustCompile(`^(\d+) ago$`)
+
+// selectSnapshot picks one snapshot from the given list according to the
+// selector string sel. This can be "latest" for the youngest complete
+// snapshot, "N ago" for the Nth complete snapshot before that, a snapshot
+// directory name, or a start time given either in unix seconds, as
+// "2006-01-02 15:04:05" or in the format of the symlinks created by
+// updateSymlinks.
+func selectSnapshot(sl snapshotList, sel string) (*snapshot, error) {
+	complete := sl.state(stateComplete, none)
+	if sel == "latest" {
+		sel = "0 ago"
+	}
+	if m := agoSelector.FindStringSubmatch(sel); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+		if n >= len(complete) {
+			return nil, fmt.Errorf("only %d complete snapshots available", len(complete))
+		}
+		return complete[len(complete)-1-n], nil
+	}
+	for _, sn := range sl {
+		if sn.Name() == sel {
+			return sn, nil
+		}
+	}
+	var t time.Time
+	if i, err := strconv.ParseInt(sel, 10, 64); err == nil {
+		t = time.Unix(i, 0)
+	} else {
+		for _, layout := range []string{
+			"Monday_2006-01-02_15.04.05",
+			"2006-01-02_15.04.05",
+			"2006-01-02 15:04:05",
+		} {
+			if t, err = time.ParseInLocation(layout, sel, time.Local); err == nil {
+				break
+			}
+		}
+		if t.IsZero() {
+			return nil, fmt.Errorf("can not understand snapshot selector: %s", sel)
+		}
+	}
+	for _, sn := range complete {
+		if sn.startTime.Equal(t) {
+			return sn, nil
+		}
+	}
+	return nil, fmt.Errorf("no complete snapshot found for %s", sel)
+}
+
+// createRestoreCommand returns an exec.Command structure that, when executed,
+// copies path from inside the snapshot sn to dest, using the rsync settings
+// of the repository.
+func createRestoreCommand(sn *snapshot, path, dest string, dryRun bool) *exec.Cmd {
+	src := filepath.Join(sn.FullName(), filepath.Clean("/"+path))
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		// copy the contents of the directory, not the directory itself
+		src += "/"
+	}
+	cmd := exec.Command(config.RsyncPath)
+	args := make([]string, 0, 256)
+	args = append(args, config.RsyncPath)
+	args = append(args, "-a")
+	args = append(args, config.RsyncOpts...)
+	if dryRun {
+		args = append(args, "--dry-run", "-v")
+	}
+	args = append(args, src, dest)
+	cmd.Args = args
+	log.Println("run:", args)
+	return cmd
+}
+
+// isEmptyDest returns true if path does not exist or is an empty directory.
+func isEmptyDest(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() {
+		return false, nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer d.Close()
+	_, err = d.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// subcmdRestore copies data from a snapshot back to a user given destination.
+func subcmdRestore(cl clock) error {
+	if cl == nil {
+		cl = new(realClock)
+	}
+	if config.restoreDest == "" {
+		return errors.New("no destination given, use -dest")
+	}
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		return err
+	}
+	sn, err := selectSnapshot(snapshots, config.restoreSnapshot)
+	if err != nil {
+		return err
+	}
+	log.Printf("restoring from snapshot %s (%s)", sn.Name(), sn.startTime.Format("2006-01-02 Monday 15:04:05"))
+	src := filepath.Join(sn.FullName(), filepath.Clean("/"+config.restorePath))
+	if _, err := os.Lstat(src); err != nil {
+		return fmt.Errorf("%s not found in snapshot %s", config.restorePath, sn.Name())
+	}
+	empty, err := isEmptyDest(config.restoreDest)
+	if err != nil {
+		return err
+	}
+	if !empty && !config.restoreForce && !config.restoreDryRun {
+		return fmt.Errorf("won't overwrite %s, use -force to restore anyway", config.restoreDest)
+	}
+	cmd := createRestoreCommand(sn, config.restorePath, config.restoreDest, config.restoreDryRun)
+	done, err := runRsyncCommand(cmd, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("rsync failed: %s", err)
+	}
+	log.Println("restore finished")
+	return nil
+}
@@ -0,0 +1,93 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type selectTestPair struct {
+	sel  string
+	snS  string
+	fail bool
+}
+
+func TestSelectSnapshot(t *testing.T) {
+	mockConfig()
+	mockRepositoryDangling()
+	defer os.RemoveAll(config.repository)
+	cl := newSkewClock(startAt)
+	sl, _ := findSnapshots(cl)
+	stime := time.Unix(1400337691, 0).Format("2006-01-02 15:04:05")
+	tests := []selectTestPair{
+		{"latest", "1400337721-1400337722 Complete", false},
+		{"0 ago", "1400337721-1400337722 Complete", false},
+		{"2 ago", "1400337706-1400337707 Complete", false},
+		{"7 ago", "", true},
+		{"1400337691", "1400337691-1400337692 Complete", false},
+		{stime, "1400337691-1400337692 Complete", false},
+		{"1400337711-1400337712-obsolete", "1400337711-1400337712 Obsolete", false},
+		{"1400337711", "", true},
+		{"yesterday", "", true},
+	}
+	for _, pair := range tests {
+		sn, err := selectSnapshot(sl, pair.sel)
+		if pair.fail {
+			if err == nil {
+				t.Errorf("selectSnapshot(%q) did not fail, but it should", pair.sel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("selectSnapshot(%q) gave error %v", pair.sel, err)
+			continue
+		}
+		if s := sn.String(); s != pair.snS {
+			t.Errorf("selectSnapshot(%q) found %v, should be %v", pair.sel, s, pair.snS)
+		}
+	}
+}
+
+func TestCreateRestoreCommand(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	config.RsyncPath = "/usr/bin/rsync"
+	sn := newSnapshot(time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete)
+	cmd := createRestoreCommand(sn, "", "/tmp/restored", true)
+	wanted := []string{"/usr/bin/rsync", "-a", "--dry-run", "-v",
+		filepath.Join(config.repository, dataSubdir, "1400337531-1400337532-complete") + "/",
+		"/tmp/restored"}
+	if !reflect.DeepEqual(cmd.Args, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, cmd.Args)
+	}
+	cmd = createRestoreCommand(sn, "../../etc/passwd", "/tmp/restored", false)
+	wanted = []string{"/usr/bin/rsync", "-a",
+		filepath.Join(config.repository, dataSubdir, "1400337531-1400337532-complete", "etc/passwd"),
+		"/tmp/restored"}
+	if !reflect.DeepEqual(cmd.Args, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, cmd.Args)
+	}
+}
+
+func TestIsEmptyDest(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	if empty, err := isEmptyDest(filepath.Join(config.repository, "notexist")); !empty || err != nil {
+		t.Errorf("non-existing destination should count as empty (%v)", err)
+	}
+	if empty, err := isEmptyDest(config.repository); !empty || err != nil {
+		t.Errorf("empty directory should count as empty (%v)", err)
+	}
+	os.Create(filepath.Join(config.repository, "somefile"))
+	if empty, _ := isEmptyDest(config.repository); empty {
+		t.Errorf("non-empty directory should not count as empty")
+	}
+	if empty, _ := isEmptyDest(filepath.Join(config.repository, "somefile")); empty {
+		t.Errorf("existing file should not count as empty")
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
@@ -13,10 +14,15 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// rsyncKillGrace is the time rsync gets to exit after SIGTERM, before it is
+// killed.
+const rsyncKillGrace = time.Second * 10
+
 // rsyncIgnoredErrors are rsync return values that are considered temporary
 // errors. If rsync returns one of these error codes, snaprd will not fail and
 // try again next time.
@@ -48,19 +54,58 @@ func createRsyncCommand(sn *snapshot, base *snapshot) *exec.Cmd {
 	args = append(args, "-a")
 	args = append(args, "--stats")
 	args = append(args, config.RsyncOpts...)
+	if config.RsyncNoProgressTimeout > 0 && !hasProgressOpt(config.RsyncOpts) {
+		// otherwise rsync prints nothing until the transfer is finished
+		args = append(args, "--info=progress2")
+	}
 	if base != nil {
 		args = append(args, "--link-dest="+base.FullName())
 	}
 	args = append(args, config.Origin, sn.FullName())
 	cmd.Args = args
 	cmd.Dir = filepath.Join(config.repository, dataSubdir)
+	// rsync starts child processes, which have to be terminated as well on
+	// timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	log.Println("run:", args)
 	return cmd
 }
 
+// hasProgressOpt returns true if one of the rsync options makes rsync report
+// its progress.
+func hasProgressOpt(o opts) bool {
+	for _, opt := range o {
+		if opt == "--progress" || opt == "-P" ||
+			(strings.HasPrefix(opt, "--info=") && strings.Contains(opt, "progress")) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanOutput is a bufio.SplitFunc like bufio.ScanLines, but a line also ends
+// at \r, which rsync uses for progress updates. The line ending is kept, so
+// both can be told apart.
+func scanOutput(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
 // runRsyncCommand executes the given command. On sucessful startup return an
-// error channel the caller can receive a return status from.
-func runRsyncCommand(cmd *exec.Cmd) (chan error, error) {
+// error channel the caller can receive a return status from. If stats is not
+// nil, it will be filled from the --stats output of rsync. It is safe to read
+// stats after the return status has been received. If activity is not nil,
+// something is sent to it for every line of output and every progress
+// update, unless the receiver is busy.
+func runRsyncCommand(cmd *exec.Cmd, stats *rsyncStats, activity chan<- struct{}) (chan error, error) {
 	var err error
 	cmdOutput, err := cmd.StdoutPipe()
 	if err != nil {
@@ -72,15 +117,29 @@ func runRsyncCommand(cmd *exec.Cmd) (chan error, error) {
 	if err != nil {
 		return nil, err
 	}
-	in := bufio.NewScanner(cmdOutput)
-	for in.Scan() {
-		log.Printf("(rsync) %s", in.Text())
-	}
-	if err := in.Err(); err != nil {
-		log.Printf("error scanning rsync output: %s", err)
-	}
 	done := make(chan error)
 	go func() {
+		in := bufio.NewScanner(cmdOutput)
+		in.Split(scanOutput)
+		for in.Scan() {
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+			line := in.Text()
+			if strings.HasSuffix(line, "\r") {
+				// progress updates are too frequent to be logged
+				continue
+			}
+			line = strings.TrimSuffix(line, "\n")
+			log.Printf("(rsync) %s", line)
+			if stats != nil {
+				stats.parseLine(line)
+			}
+		}
+		if err := in.Err(); err != nil {
+			log.Printf("error scanning rsync output: %s", err)
+		}
 		time.Sleep(time.Second)
 		done <- cmd.Wait()
 		return
@@ -88,10 +147,93 @@ func runRsyncCommand(cmd *exec.Cmd) (chan error, error) {
 	return done, nil
 }
 
+// killRsyncCommand sends sig to the process group of cmd, which has been
+// started by runRsyncCommand, and waits for it to exit. If it does not exit in
+// time, it is killed.
+func killRsyncCommand(cmd *exec.Cmd, done chan error, sig syscall.Signal) {
+	pgid := -cmd.Process.Pid
+	log.Printf("sending %s to rsync process group", sig)
+	syscall.Kill(pgid, sig)
+	select {
+	case <-done:
+	case <-time.After(rsyncKillGrace):
+		log.Println("rsync did not terminate, killing it")
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// runRsyncOnce runs rsync for newSn and waits for it to finish. It returns
+// the exit code of rsync together with the error from exec. An error is
+// returned as abort if rsync did not run to its end, because it could not be
+// started, has been killed by a signal, or timed out.
+func runRsyncOnce(newSn, base *snapshot, stats *rsyncStats, sigc chan os.Signal) (code int, err error, abort error) {
+	cmd := createRsyncCommand(newSn, base)
+	startedAt := time.Now()
+	activity := make(chan struct{})
+	done, err := runRsyncCommand(cmd, stats, activity)
+	if err != nil {
+		log.Println("could not start rsync command:", err)
+		return -1, nil, err
+	}
+	debugf("rsync started")
+	// nil channels block forever, so disabled timeouts never fire
+	var timeout, noProgress <-chan time.Time
+	if config.RsyncTimeout > 0 {
+		timeout = time.After(config.RsyncTimeout)
+	}
+	var noProgressTimer *time.Timer
+	if config.RsyncNoProgressTimeout > 0 {
+		noProgressTimer = time.NewTimer(config.RsyncNoProgressTimeout)
+		defer noProgressTimer.Stop()
+		noProgress = noProgressTimer.C
+	}
+	for {
+		select {
+		case sig := <-sigc:
+			debugf("trying to kill rsync with signal %v", sig)
+			s, ok := sig.(syscall.Signal)
+			if !ok {
+				s = syscall.SIGTERM
+			}
+			killRsyncCommand(cmd, done, s)
+			return -1, nil, errors.New("rsync killed by request")
+		case <-activity:
+			if noProgressTimer != nil {
+				if !noProgressTimer.Stop() {
+					<-noProgressTimer.C
+				}
+				noProgressTimer.Reset(config.RsyncNoProgressTimeout)
+			}
+		case <-timeout:
+			return -1, nil, rsyncTimedOut(cmd, done, newSn,
+				fmt.Sprintf("rsync did not finish within %s", config.RsyncTimeout))
+		case <-noProgress:
+			return -1, nil, rsyncTimedOut(cmd, done, newSn,
+				fmt.Sprintf("rsync did not show any progress for %s", config.RsyncNoProgressTimeout))
+		case err := <-done:
+			debugf("received something on done channel: %v", err)
+			stats.Duration = time.Since(startedAt).Seconds()
+			if err == nil {
+				return 0, nil, nil
+			}
+			// At this stage rsync ran, but with errors. Get the error code.
+			if exiterr, ok := err.(*exec.ExitError); ok { // The return code != 0)
+				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok { // Finally get the actual status code
+					debugf("The error code we got is: %v", status.ExitStatus())
+					return status.ExitStatus(), err, nil
+				}
+			}
+			return -1, err, nil
+		}
+	}
+}
+
 // createSnapshot starts a potentially long running rsync command and returns a
 // Snapshot pointer on success.
-// For non-zero return values of rsync potentially restart the process if the
-// error was presumably volatile.
+// For non-zero return values of rsync, the action is taken from the
+// -rsyncPolicy: accept the snapshot, fail, or restart rsync after a waiting
+// time that doubles with every attempt.
 func createSnapshot(base *snapshot) (*snapshot, error) {
 	cl := new(realClock)
 
@@ -102,54 +244,100 @@ func createSnapshot(base *snapshot) (*snapshot, error) {
 	} else {
 		newSn.transIncomplete(cl)
 	}
-	cmd := createRsyncCommand(newSn, base)
-	done, err := runRsyncCommand(cmd)
+	// After a partial snapshot, the create loop passes it in as base, but
+	// complete snapshots are preferred as base.
+	if base == nil || base.state != stateComplete {
+		base = lastBaseFromDisk(cl)
+	}
+	err := runPreHook(newSn, base)
 	if err != nil {
-		log.Println("could not start rsync command:", err)
 		return nil, err
 	}
-	debugf("rsync started")
+	// The post hook runs whenever the pre hook succeeded, so it can undo
+	// whatever the pre hook did, even if rsync failed.
+	rsyncExit := -1
+	defer func() { runPostHook(newSn, base, rsyncExit) }()
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	for {
-		select {
-		case sig := <-sigc:
-			debugf("trying to kill rsync with signal %v", sig)
-			err := cmd.Process.Signal(sig)
-			if err != nil {
-				log.Fatal("failed to kill: ", err)
+	defer signal.Stop(sigc)
+	backoff := config.RsyncRetryBackoff
+	var stats *rsyncStats
+	for attempt := 0; ; attempt++ {
+		stats = new(rsyncStats)
+		code, err, abort := runRsyncOnce(newSn, base, stats, sigc)
+		if abort != nil {
+			return nil, abort
+		}
+		rsyncExit = code
+		stats.ExitCode = code
+		metrics.rsyncExited(code)
+		if code == 0 {
+			break
+		}
+		action := rsyncPolicyFor(code)
+		if action == rsyncRetry && attempt < config.RsyncRetries {
+			log.Printf("rsync error %d: %s, retrying in %s (attempt %d of %d)",
+				code, rsyncExitDescription(code), backoff, attempt+1, config.RsyncRetries)
+			select {
+			case sig := <-sigc:
+				return nil, fmt.Errorf("retry cancelled by signal %s", sig)
+			case <-time.After(backoff):
 			}
-			return nil, errors.New("rsync killed by request")
-		case err := <-done:
-			debugf("received something on done channel: %v", err)
+			backoff *= 2
+			continue
+		}
+		if action == rsyncRetry {
+			reason := fmt.Sprintf("rsync error %d: %s, giving up after %d retries", code, rsyncExitDescription(code), config.RsyncRetries)
+			log.Println(reason)
+			notifyRsyncIssue(err, code)
+			return nil, skipError{reason}
+		}
+		if action == rsyncFail {
+			return nil, fmt.Errorf("rsync failed: %s", err)
+		}
+		if action == rsyncPartial {
+			log.Printf("rsync error %d: %s, keeping snapshot as partial", code, rsyncExitDescription(code))
+			notifyRsyncIssue(err, code)
+			err = newSn.transPartial(cl)
 			if err != nil {
-				// At this stage rsync ran, but with errors.
-				failed := true
-				// First, get the error code
-				if exiterr, ok := err.(*exec.ExitError); ok { // The return code != 0)
-					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok { // Finally get the actual status code
-						rsyncRet := status.ExitStatus()
-						debugf("The error code we got is: %v", rsyncRet)
-						if errmsg, ok := rsyncIgnoredErrors[rsyncRet]; ok == true {
-							log.Printf("ignoring rsync error %d: %s", rsyncRet, errmsg)
-							// 24 ("files vanished") happens too often and is usually harmless
-							if rsyncRet != 24 && config.Notify != "" {
-								RsyncIssueMail(err, rsyncRet)
-							}
-							failed = false
-						}
-					}
-				}
-				if failed {
-					return nil, fmt.Errorf("rsync failed: %s", err)
-				}
+				return nil, err
 			}
-			err = newSn.transComplete(cl)
+			log.Println("finished partial:", newSn.Name())
+			log.Println("stats:", stats)
+			err = newSn.writeMeta(&snapshotMeta{Stats: stats})
 			if err != nil {
-				return nil, err
+				log.Println("could not write snapshot metadata:", err)
 			}
-			log.Println("finished:", newSn.Name())
 			return newSn, nil
 		}
+		log.Printf("accepting rsync error %d: %s", code, rsyncExitDescription(code))
+		// 24 ("files vanished") happens too often and is usually harmless
+		if code != 24 {
+			notifyRsyncIssue(err, code)
+		}
+		break
+	}
+	err = newSn.transComplete(cl)
+	if err != nil {
+		return nil, err
 	}
+	log.Println("finished:", newSn.Name())
+	metrics.snapshotCreated(newSn)
+	log.Println("stats:", stats)
+	err = newSn.writeMeta(&snapshotMeta{Stats: stats})
+	if err != nil {
+		log.Println("could not write snapshot metadata:", err)
+	}
+	return newSn, nil
+}
+
+// rsyncTimedOut stops a hung rsync and notifies about it. The incomplete
+// snapshot is left in place, so it will be reused next time. Returns a
+// skipError, so snaprd will try again in the next cycle.
+func rsyncTimedOut(cmd *exec.Cmd, done chan error, sn *snapshot, reason string) error {
+	log.Println(reason)
+	killRsyncCommand(cmd, done, syscall.SIGTERM)
+	notifyEvent("rsync_timeout", fmt.Sprintf("snaprd rsync timeout (origin: %s)", config.Origin),
+		fmt.Sprintf("%s and has been terminated.\nThe incomplete snapshot %s will be reused next time.", reason, sn.Name()))
+	return skipError{reason}
 }
@@ -3,9 +3,15 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -66,3 +72,185 @@ func TestFakeRsyncFail(t *testing.T) {
 		t.Errorf("createSnapshot() succeeded, but it should have failed: %v", got)
 	}
 }
+
+func TestRsyncTimeout(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	// a stand-in for rsync that hangs after creating the target directory
+	rsync := filepath.Join(config.repository, "rsync")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nfor last; do :; done\nmkdir -p \"$last\"\necho started\nsleep 60\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	for _, timeouts := range [][2]time.Duration{
+		{time.Second, 0},
+		{0, time.Second},
+	} {
+		config.RsyncTimeout = timeouts[0]
+		config.RsyncNoProgressTimeout = timeouts[1]
+		startedAt := time.Now()
+		_, err := createSnapshot(nil)
+		if _, ok := err.(skipError); !ok {
+			t.Errorf("createSnapshot() with timeouts %v returned %v, wanted a skipError", timeouts, err)
+		}
+		if d := time.Since(startedAt); d > time.Second*10 {
+			t.Errorf("createSnapshot() with timeouts %v took %s", timeouts, d)
+		}
+		cl := new(realClock)
+		if sn := lastReusableFromDisk(cl); sn == nil {
+			t.Errorf("no incomplete snapshot left for reuse after timeout")
+		}
+	}
+}
+
+func TestRsyncRetry(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	// a stand-in for rsync that fails with a connection error on the first
+	// run and records the target directories
+	rsync := filepath.Join(config.repository, "rsync")
+	runs := filepath.Join(config.repository, "runs")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nfor last; do :; done\nmkdir -p \"$last\"\necho \"$last\" >> "+runs+
+		"\n[ $(wc -l < "+runs+") -gt 1 ] || exit 30\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	config.RsyncRetries = 2
+	config.RsyncRetryBackoff = time.Millisecond
+	sn, err := createSnapshot(nil)
+	if err != nil {
+		t.Fatalf("createSnapshot() returned an error, but it shouldn't: %v", err)
+	}
+	b, _ := ioutil.ReadFile(runs)
+	dirs := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(dirs) != 2 || dirs[0] != dirs[1] {
+		t.Errorf("rsync ran into %q, wanted two runs into the same directory", dirs)
+	}
+	if sn.state != stateComplete {
+		t.Errorf("snapshot is %s after retry, wanted complete", sn.state)
+	}
+
+	// give up after all retries failed
+	config.rsyncPolicy, _ = parseRsyncPolicy("1:retry")
+	config.RsyncRetries = 1
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	_, err = createSnapshot(sn)
+	if _, ok := err.(skipError); !ok {
+		t.Errorf("createSnapshot() returned %v after failed retries, wanted a skipError", err)
+	}
+	config.rsyncPolicy, _ = parseRsyncPolicy("1:fail")
+	_, err = createSnapshot(sn)
+	if _, ok := err.(skipError); ok || err == nil {
+		t.Errorf("createSnapshot() returned %v, wanted a plain error", err)
+	}
+}
+
+func TestRsyncPartial(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	rsync := filepath.Join(config.repository, "rsync")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nfor last; do :; done\nmkdir -p \"$last\"\nexit 23\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	sn, err := createSnapshot(nil)
+	if err != nil {
+		t.Fatalf("createSnapshot() returned an error, but it shouldn't: %v", err)
+	}
+	if sn.state != statePartial {
+		t.Errorf("snapshot is %s after rsync exit code 23, wanted partial", sn.state)
+	}
+	if _, err := os.Stat(sn.FullName()); err != nil {
+		t.Errorf("partial snapshot not found on disk: %v", err)
+	}
+	if lastGoodFromDisk(new(realClock)) != nil {
+		t.Errorf("partial snapshot is used as lastGood")
+	}
+	// without a complete snapshot, the next one is based on the partial one
+	args := filepath.Join(config.repository, "args")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\necho \"$*\" > "+args+"\nfor last; do :; done\nmkdir -p \"$last\"\nexit 23\n"), 0755)
+	if _, err := createSnapshot(sn); err != nil {
+		t.Fatalf("createSnapshot() returned an error, but it shouldn't: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(args); !strings.Contains(string(b), "--link-dest="+sn.FullName()+" ") {
+		t.Errorf("rsync not based on the partial snapshot: %s", b)
+	}
+}
+
+func TestScanOutput(t *testing.T) {
+	in := bufio.NewScanner(strings.NewReader("building file list\n  1%\r  50%\r 100%\nsent 10 bytes"))
+	in.Split(scanOutput)
+	var got []string
+	for in.Scan() {
+		got = append(got, in.Text())
+	}
+	wanted := []string{"building file list\n", "  1%\r", "  50%\r", " 100%\n", "sent 10 bytes"}
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %q, got %q", wanted, got)
+	}
+}
+
+func TestRsyncNoProgressTimeoutProgress(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	config.RsyncNoProgressTimeout = time.Second * 2
+	cmd := createRsyncCommand(newIncompleteSnapshot(new(realClock)), nil)
+	if !hasProgressOpt(cmd.Args) {
+		t.Errorf("rsync runs without a progress option: %v", cmd.Args)
+	}
+	config.RsyncOpts = opts{"--progress"}
+	if cmd := createRsyncCommand(newIncompleteSnapshot(new(realClock)), nil); strings.Contains(strings.Join(cmd.Args, " "), "--info") {
+		t.Errorf("progress option added although there is one already: %v", cmd.Args)
+	}
+	// a stand-in for rsync that reports progress only with \r, for longer
+	// than the timeout
+	rsync := filepath.Join(config.repository, "rsync")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nfor last; do :; done\nmkdir -p \"$last\"\n"+
+		"for i in 1 2 3 4 5 6 7 8 9 10 11 12; do printf ' %d%%\\r' $i; sleep 0.3; done\necho\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	sn, err := createSnapshot(nil)
+	if err != nil {
+		t.Fatalf("createSnapshot() returned %v, but rsync showed progress", err)
+	}
+	if sn.state != stateComplete {
+		t.Errorf("snapshot is %s, wanted complete", sn.state)
+	}
+}
+
+func TestRsyncSignal(t *testing.T) {
+	mockConfig()
+	defer os.RemoveAll(config.repository)
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir), 0777)
+	// a stand-in for rsync with a child process, like rsync over ssh
+	rsync := filepath.Join(config.repository, "rsync")
+	child := filepath.Join(config.repository, "child")
+	ioutil.WriteFile(rsync, []byte("#!/bin/sh\nsleep 100 &\necho $! > "+child+".tmp\nmv "+child+".tmp "+child+"\nwait\n"), 0755)
+	config.RsyncPath = rsync
+	config.Origin = "/nonexistent/"
+	sigc := make(chan os.Signal, 1)
+	aborted := make(chan error)
+	go func() {
+		_, _, abort := runRsyncOnce(newIncompleteSnapshot(new(realClock)), nil, new(rsyncStats), sigc)
+		aborted <- abort
+	}()
+	var b []byte
+	for i := 0; i < 50 && len(b) == 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+		b, _ = ioutil.ReadFile(child)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatalf("child of rsync did not start: %v", err)
+	}
+	sigc <- syscall.SIGTERM
+	if err := <-aborted; err == nil {
+		t.Errorf("runRsyncOnce() did not report the abort")
+	}
+	// a zombie waiting for init is dead as well
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil && !strings.Contains(string(stat), ") Z ") {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("child of rsync survived the signal: %s", stat)
+	}
+}
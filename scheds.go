@@ -0,0 +1,122 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Description of schedules for the scheds subcommand
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// schedInterval describes one interval of a schedule. Durations are given in
+// seconds, From and To are how long ago the interval starts and ends. A From
+// or Goal of 0 in the highest interval means there is no limit.
+type schedInterval struct {
+	Interval int
+	Spacing  float64
+	From     float64
+	To       float64
+	Goal     int
+}
+
+// schedInfo describes a schedule for the scheds subcommand. Snapshots is the
+// number of snapshots kept once the schedule is filled, Retention how far
+// back in seconds they reach. Both are 0 if maxKeep does not limit them.
+type schedInfo struct {
+	Name      string
+	Intervals []schedInterval
+	Snapshots int
+	Retention float64
+}
+
+// describe returns the intervals of the receiver, starting with the oldest
+// one like the list subcommand, together with the totals when at most maxKeep
+// snapshots are kept in the highest interval.
+func (il intervalList) describe(name string, maxKeep int) schedInfo {
+	si := schedInfo{Name: name, Intervals: []schedInterval{}}
+	if len(il) < 2 {
+		return si
+	}
+	highest := len(il) - 2
+	for n := highest; n >= 0; n-- {
+		iv := schedInterval{
+			Interval: n,
+			Spacing:  il[n].Seconds(),
+			To:       il.offset(n).Seconds(),
+		}
+		if n < highest {
+			iv.From = il.offset(n + 1).Seconds()
+			iv.Goal = il.goal(n)
+		} else if maxKeep != 0 {
+			iv.From = (il.offset(n) + il[n]*time.Duration(maxKeep)).Seconds()
+			iv.Goal = maxKeep
+		}
+		si.Snapshots += iv.Goal
+		si.Intervals = append(si.Intervals, iv)
+	}
+	if maxKeep != 0 {
+		si.Retention = si.Intervals[0].From
+	} else {
+		si.Snapshots = 0
+	}
+	return si
+}
+
+// seconds converts a number of seconds as used in schedInfo back into a
+// duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// writeSchedText writes a human readable description of si to w.
+func writeSchedText(w io.Writer, si schedInfo, il intervalList) {
+	spans := make([]string, len(il))
+	for i, d := range il {
+		spans[i] = formatSpan(d)
+	}
+	fmt.Fprintf(w, "%s: [%s]\n", si.Name, strings.Join(spans, " "))
+	finite := 0
+	for _, iv := range si.Intervals {
+		to := "now"
+		if iv.To != 0 {
+			to = formatSpan(seconds(iv.To)) + " ago"
+		}
+		if iv.From == 0 {
+			fmt.Fprintf(w, "  every %s from past to %s: ∞\n", formatSpan(seconds(iv.Spacing)), to)
+			continue
+		}
+		fmt.Fprintf(w, "  every %s from %s ago to %s: %d\n",
+			formatSpan(seconds(iv.Spacing)), formatSpan(seconds(iv.From)), to, iv.Goal)
+		finite += iv.Goal
+	}
+	if si.Retention != 0 {
+		fmt.Fprintf(w, "  snapshots: %d, retention: %s\n", si.Snapshots, formatSpan(seconds(si.Retention)))
+	} else if len(si.Intervals) > 0 {
+		fmt.Fprintf(w, "  snapshots: %d plus one every %s, retention: forever\n",
+			finite, formatSpan(seconds(si.Intervals[0].Spacing)))
+	}
+}
+
+// list prints the stored schedules in the list, using the given format.
+func (schl scheduleList) list(w io.Writer, format string, maxKeep int) error {
+	infos := []schedInfo{}
+	for _, name := range schl.names() {
+		infos = append(infos, schl[name].describe(name, maxKeep))
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+	for i, si := range infos {
+		writeSchedText(w, si, schl[si.Name])
+		if i < len(infos)-1 {
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
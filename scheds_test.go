@@ -0,0 +1,54 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestScheduleDescribe(t *testing.T) {
+	il := intervalList{second * 5, second * 20, second * 40, long}
+	got := il.describe("test", 2)
+	wantIntervals := []schedInterval{
+		{Interval: 2, Spacing: 40, From: 140, To: 60, Goal: 2},
+		{Interval: 1, Spacing: 20, From: 60, To: 20, Goal: 2},
+		{Interval: 0, Spacing: 5, From: 20, To: 0, Goal: 4},
+	}
+	if !reflect.DeepEqual(got.Intervals, wantIntervals) {
+		t.Errorf("got intervals %+v, expected %+v", got.Intervals, wantIntervals)
+	}
+	if got.Snapshots != 8 || got.Retention != 140 {
+		t.Errorf("got %d snapshots and retention %v, expected 8 and 140", got.Snapshots, got.Retention)
+	}
+	got = il.describe("test", 0)
+	if got.Snapshots != 0 || got.Retention != 0 || got.Intervals[0].From != 0 || got.Intervals[0].Goal != 0 {
+		t.Errorf("expected no limit without maxKeep, got %+v", got)
+	}
+}
+
+func TestSchedsJSON(t *testing.T) {
+	schl := scheduleList{"test": {second * 5, second * 20, long}}
+	var b bytes.Buffer
+	if err := schl.list(&b, "json", 3); err != nil {
+		t.Fatal(err)
+	}
+	var infos []schedInfo
+	if err := json.Unmarshal(b.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	want := []schedInfo{{
+		Name: "test",
+		Intervals: []schedInterval{
+			{Interval: 1, Spacing: 20, From: 80, To: 20, Goal: 3},
+			{Interval: 0, Spacing: 5, From: 20, To: 0, Goal: 4},
+		},
+		Snapshots: 7,
+		Retention: 80,
+	}}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("got %+v, expected %+v", infos, want)
+	}
+}
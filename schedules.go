@@ -6,12 +6,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 const (
@@ -25,6 +32,76 @@ const (
 	long   = year * 100
 )
 
+// spanUnits are the units that can be used to specify time spans in
+// schedule files and on the command line.
+var spanUnits = map[string]time.Duration{
+	"s":      second,
+	"second": second,
+	"m":      minute,
+	"minute": minute,
+	"h":      hour,
+	"hour":   hour,
+	"d":      day,
+	"day":    day,
+	"w":      week,
+	"week":   week,
+	"M":      month,
+	"month":  month,
+	"y":      year,
+	"year":   year,
+}
+
+// spanFormatUnits are the units used by formatSpan, largest first.
+var spanFormatUnits = []string{"y", "M", "w", "d", "h", "m", "s"}
+
+var spanPart = regexp.MustCompile(`^(\d+)([a-zA-Z]+)`)
+
+// parseSpan converts a string like "1d12h" or "2y" into a duration. The
+// units are the same as in schedule files.
+func parseSpan(s string) (time.Duration, error) {
+	var d time.Duration
+	rest := s
+	for rest != "" {
+		m := spanPart.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("malformed time span: %s", s)
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+		unit, ok := spanUnits[m[2]]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit %s in time span: %s", m[2], s)
+		}
+		d += time.Duration(n) * unit
+		rest = rest[len(m[0]):]
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("time span must be positive: %s", s)
+	}
+	return d, nil
+}
+
+// formatSpan is the reverse of parseSpan, it formats d like "1M1w1d" using
+// the largest units possible. The innumerable interval is "forever".
+func formatSpan(d time.Duration) string {
+	if d == long {
+		return "forever"
+	}
+	if d < second {
+		return d.String()
+	}
+	var b strings.Builder
+	for _, u := range spanFormatUnits {
+		if n := d / spanUnits[u]; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u)
+			d -= n * spanUnits[u]
+		}
+	}
+	return b.String()
+}
+
 type intervalList []time.Duration
 
 // offset returns how long ago the given interval started
@@ -35,17 +112,110 @@ func (il intervalList) offset(i int) time.Duration {
 	return il[i] + il.offset(i-1)
 }
 
-// goal returns how many snapshots are the goal in the given interval
+// goal returns how many snapshots are the goal in the given interval. The
+// highest interval is innumerable, for it and for invalid intervals the goal
+// is 0.
 func (il intervalList) goal(i int) int {
-	if i > len(il)-2 {
-		panic("this should not happen: highest interval is innumerable!")
+	if i < 0 || i > len(il)-2 || il[i] <= 0 {
+		return 0
 	}
 	return int(il[i+1] / il[i])
 }
 
+// validate checks that the receiver can be used as a schedule: every interval
+// must be positive and longer than the previous one, and the list must end
+// with the innumerable interval long. All problems found are returned.
+func (il intervalList) validate() []error {
+	var errs []error
+	if len(il) < 2 {
+		return append(errs, errors.New("at least one interval and the terminal interval long are needed"))
+	}
+	last := len(il) - 1
+	for i, d := range il[:last] {
+		switch {
+		case d <= 0:
+			errs = append(errs, fmt.Errorf("interval %d: must be positive, got %s", i+1, d))
+		case d == long:
+			errs = append(errs, fmt.Errorf("interval %d: long is only allowed as the last interval", i+1))
+		case i > 0 && il[i-1] > 0 && d <= il[i-1]:
+			errs = append(errs, fmt.Errorf("interval %d: %s is not longer than the previous interval %s", i+1, d, il[i-1]))
+		}
+	}
+	if il[last] != long {
+		errs = append(errs, fmt.Errorf("interval %d: missing terminal interval long", last+1))
+	}
+	return errs
+}
+
+// warnings returns the intervals of the receiver that are not a multiple of
+// the previous one. Such schedules have always been accepted, but the goals
+// of their intervals are rounded down, so scheds -check rejects them.
+func (il intervalList) warnings() []error {
+	var errs []error
+	for i := 1; i < len(il)-1; i++ {
+		if il[i-1] > 0 && il[i] > il[i-1] && il[i]%il[i-1] != 0 {
+			errs = append(errs, fmt.Errorf("interval %d: %s is not a multiple of the previous interval %s", i+1, il[i], il[i-1]))
+		}
+	}
+	return errs
+}
+
 type scheduleList map[string]intervalList
 
-type jsonInterval []map[string]time.Duration
+// jsonInterval is a schedule as read from a schedule file.
+type jsonInterval []intervalSpec
+
+// intervalSpec is one interval in a schedule file. It is either given as a
+// time span like "1d12h" or "forever", or as a map of units like
+// { "day": 1, "hour": 12 }.
+type intervalSpec struct {
+	span  string
+	units map[string]json.Number
+}
+
+func (s *intervalSpec) UnmarshalJSON(b []byte) error {
+	*s = intervalSpec{}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &s.span)
+	}
+	return json.Unmarshal(b, &s.units)
+}
+
+// newIntervalSpec converts an interval as decoded from TOML.
+func newIntervalSpec(v interface{}) (intervalSpec, error) {
+	switch v := v.(type) {
+	case string:
+		return intervalSpec{span: v}, nil
+	case map[string]interface{}:
+		units := make(map[string]json.Number)
+		for k, n := range v {
+			switch n := n.(type) {
+			case int64:
+				units[k] = json.Number(strconv.FormatInt(n, 10))
+			case float64:
+				units[k] = json.Number(strconv.FormatFloat(n, 'g', -1, 64))
+			default:
+				return intervalSpec{}, fmt.Errorf("%s is not a number: %v", k, n)
+			}
+		}
+		return intervalSpec{units: units}, nil
+	}
+	return intervalSpec{}, fmt.Errorf("neither a time span nor a table of units: %v", v)
+}
+
+// scheduleError describes everything that is wrong with one schedule.
+type scheduleError struct {
+	schedule string
+	problems []error
+}
+
+func (e *scheduleError) Error() string {
+	a := make([]string, len(e.problems))
+	for i, p := range e.problems {
+		a[i] = p.Error()
+	}
+	return fmt.Sprintf("schedule %s: %s", e.schedule, strings.Join(a, "; "))
+}
 
 func (schl *scheduleList) String() string {
 	a := []string{}
@@ -63,37 +233,145 @@ var schedules = scheduleList{
 	"shortterm": {minute * 10, hour * 2, day, week, month, long},
 }
 
-// addFromFile adds an external JSON file to the list of available scheds
+// decodeTOMLSchedules reads schedules from TOML data like this:
+//
+//	longterm = ["6h", "1d", "1w", "4w", "forever"]
+//	custom = [{ day = 1, hour = 12 }, "2w", "forever"]
+func decodeTOMLSchedules(data string) (map[string]jsonInterval, error) {
+	var raw map[string][]interface{}
+	if _, err := toml.Decode(data, &raw); err != nil {
+		return nil, err
+	}
+	readData := make(map[string]jsonInterval)
+	for k, v := range raw {
+		ji := make(jsonInterval, len(v))
+		for i, iv := range v {
+			spec, err := newIntervalSpec(iv)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %s: interval %d: %v", k, i+1, err)
+			}
+			ji[i] = spec
+		}
+		readData[k] = ji
+	}
+	return readData, nil
+}
+
+// readScheduleFile reads an external schedule file and validates the
+// schedules in it. Files ending in .toml are read as TOML, all others as
+// JSON. The valid schedules are returned, and a scheduleError for each
+// invalid one, sorted by name. If strict is false, schedules that only have
+// warnings are valid, and the warnings are logged.
+func readScheduleFile(file string, strict bool) (scheduleList, []*scheduleError, error) {
+	schedFile, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening schedule file: %v", err)
+	}
+	var readData map[string]jsonInterval
+	if filepath.Ext(file) == ".toml" {
+		readData, err = decodeTOMLSchedules(string(schedFile))
+	} else {
+		err = json.Unmarshal(schedFile, &readData)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing schedule file: %v", err)
+	}
+	schl := make(scheduleList)
+	var invalid []*scheduleError
+	for k, v := range readData {
+		il, errs := v.intervalList()
+		if errs == nil {
+			errs = il.validate()
+		}
+		if errs == nil {
+			if warns := il.warnings(); warns != nil {
+				if strict {
+					errs = warns
+				} else {
+					log.Printf("warning: %s", &scheduleError{k, warns})
+				}
+			}
+		}
+		if errs != nil {
+			invalid = append(invalid, &scheduleError{k, errs})
+			continue
+		}
+		schl[k] = il
+	}
+	sort.Slice(invalid, func(i, j int) bool {
+		return invalid[i].schedule < invalid[j].schedule
+	})
+	return schl, invalid, nil
+}
+
+// addFromFile adds an external schedule file to the list of available scheds.
+// Nothing is added if any of the schedules in the file is invalid.
 func (schl scheduleList) addFromFile(file string) error {
 	// If we are using the default file name, and it doesn't exist, no problem, just return
 	if _, err := os.Stat(file); os.IsNotExist(err) && file == defaultSchedFileName {
 		return nil
 	}
-	schedFile, err := ioutil.ReadFile(file)
+	read, invalid, err := readScheduleFile(file, false)
 	if err != nil {
-		return fmt.Errorf("Error opening schedule file: %v", err)
+		return err
 	}
-	var readData map[string]jsonInterval
-	err = json.Unmarshal(schedFile, &readData)
+	if len(invalid) > 0 {
+		a := make([]string, len(invalid))
+		for i, e := range invalid {
+			a[i] = e.Error()
+		}
+		return fmt.Errorf("invalid schedule file %s:\n%s", file, strings.Join(a, "\n"))
+	}
+	for k, v := range read {
+		schl[k] = v
+	}
+	return nil
+}
+
+// addValidFromFile is a lenient version of addFromFile. The valid schedules
+// of the file are added even if others are invalid, and the invalid ones are
+// returned.
+func (schl scheduleList) addValidFromFile(file string) ([]*scheduleError, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) && file == defaultSchedFileName {
+		return nil, nil
+	}
+	read, invalid, err := readScheduleFile(file, false)
 	if err != nil {
-		return fmt.Errorf("Error parsing schedule file: %v", err)
+		return nil, err
 	}
-	for k, v := range readData {
-		schl[k] = v.intervalList()
+	for k, v := range read {
+		schl[k] = v
+	}
+	return invalid, nil
+}
+
+// checkScheduleFile validates the schedules in file strictly and prints the
+// valid ones and the problems of the invalid ones.
+func checkScheduleFile(file string) error {
+	read, invalid, err := readScheduleFile(file, true)
+	if err != nil {
+		return err
+	}
+	read.list(os.Stdout, "text", 0)
+	for _, e := range invalid {
+		for _, p := range e.problems {
+			fmt.Printf("%s: %s\n", e.schedule, p)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d of %d schedules in %s are invalid", len(invalid), len(read)+len(invalid), file)
 	}
 	return nil
 }
 
-// list prints the stored schedules in the list
-func (schl scheduleList) list() {
+// names returns the names of the schedules in the list, sorted.
+func (schl scheduleList) names() []string {
 	var sKeys []string
 	for k := range schl {
 		sKeys = append(sKeys, k)
 	}
 	sort.Strings(sKeys)
-	for _, name := range sKeys {
-		fmt.Printf("%s: %s\n", name, schl[name])
-	}
+	return sKeys
 }
 
 // Transform a JSON formatted intervalList like this:
@@ -103,36 +381,75 @@ func (schl scheduleList) list() {
 //   { "month" : 1, "week" : 2}
 //   { "long" : 1}
 // ]
+// or, with time spans, like this:
+// [ "1d12h", "2w", "1M2w", "forever" ]
 // and it makes it equivalent to
 // { 1*day + 12*hour, 2*week, 1*month + 2*week, long }
+// Unknown units, values that are not integers and "long" mixed with other
+// units are reported as errors.
 
-func (json jsonInterval) intervalList() intervalList {
+func (json jsonInterval) intervalList() (intervalList, []error) {
+	var errs []error
 	il := make(intervalList, len(json))
-	for i, interval := range json {
-		var duration time.Duration
-	Loop:
-		for k, v := range interval {
-			switch k {
-			case "s", "second":
-				duration += v * second
-			case "m", "minute":
-				duration += v * minute
-			case "h", "hour":
-				duration += v * hour
-			case "d", "day":
-				duration += v * day
-			case "w", "week":
-				duration += v * week
-			case "M", "month":
-				duration += v * month
-			case "y", "year":
-				duration += v * year
-			case "l", "long":
-				duration = long
-				break Loop
+	for i, spec := range json {
+		d, specErrs := spec.duration()
+		for _, err := range specErrs {
+			errs = append(errs, fmt.Errorf("interval %d: %v", i+1, err))
+		}
+		il[i] = d
+	}
+	return il, errs
+}
+
+// duration returns the length of the interval described by the receiver.
+func (s intervalSpec) duration() (time.Duration, []error) {
+	if s.units == nil {
+		switch s.span {
+		case "forever", "long":
+			return long, nil
+		case "":
+			return 0, []error{errors.New("empty")}
+		}
+		d, err := parseSpan(s.span)
+		if err != nil {
+			return 0, []error{err}
+		}
+		return d, nil
+	}
+	if len(s.units) == 0 {
+		return 0, []error{errors.New("empty")}
+	}
+	var errs []error
+	var keys []string
+	for k := range s.units {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var duration time.Duration
+	for _, k := range keys {
+		v := s.units[k]
+		n, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s is not an integer: %s", k, v))
+			continue
+		}
+		if k == "l" || k == "long" {
+			if len(s.units) > 1 {
+				errs = append(errs, errors.New("long can not be combined with other units"))
 			}
+			duration = long
+			continue
+		}
+		unit, ok := spanUnits[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown unit %q", k))
+			continue
+		}
+		if n < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative: %d", k, n))
+			continue
 		}
-		il[i] = duration
+		duration += time.Duration(n) * unit
 	}
-	return il
+	return duration, errs
 }
@@ -3,7 +3,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -68,3 +75,187 @@ func TestSchedulesAddFromFile(t *testing.T) {
 		t.Errorf("wanted %v, got %v", wanted, got)
 	}
 }
+
+func TestParseSpan(t *testing.T) {
+	tests := map[string]time.Duration{
+		"10s":    second * 10,
+		"6h":     hour * 6,
+		"1d12h":  day + hour*12,
+		"2w":     week * 2,
+		"1M":     month,
+		"2y":     year * 2,
+		"1month": month,
+	}
+	for s, wanted := range tests {
+		got, err := parseSpan(s)
+		if err != nil || got != wanted {
+			t.Errorf("parseSpan(%q) = %v, %v, wanted %v", s, got, err, wanted)
+		}
+	}
+	for _, s := range []string{"", "6", "h", "6x", "0d", "-1d", "1.5d"} {
+		if _, err := parseSpan(s); err == nil {
+			t.Errorf("parseSpan(%q) did not fail, but it should", s)
+		}
+	}
+}
+
+func TestScheduleGoalInvalid(t *testing.T) {
+	il := intervalList{0, second, long}
+	for _, i := range []int{-1, 0, 2, 3} {
+		if g := il.goal(i); g != 0 {
+			t.Errorf("goal(%d) got %d, expected 0", i, g)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	for name, il := range schedules {
+		if errs := il.validate(); errs != nil {
+			t.Errorf("built-in schedule %s is invalid: %v", name, errs)
+		}
+	}
+	tests := map[string]intervalList{
+		"interval 1: must be positive, got 0s":                                {0, hour, long},
+		"interval 2: 6h0m0s is not longer than the previous interval 24h0m0s": {day, hour * 6, long},
+		"interval 2: missing terminal interval long":                          {hour, day},
+		"interval 1: long is only allowed as the last interval":               {long, long},
+		"at least one interval and the terminal interval long are needed":     {long},
+	}
+	for want, il := range tests {
+		errs := il.validate()
+		if len(errs) != 1 || errs[0].Error() != want {
+			t.Errorf("validate(%v) got %v, expected %s", il, errs, want)
+		}
+	}
+}
+
+func TestScheduleWarnings(t *testing.T) {
+	for name, il := range schedules {
+		if warns := il.warnings(); warns != nil {
+			t.Errorf("built-in schedule %s has warnings: %v", name, warns)
+		}
+	}
+	il := intervalList{hour * 5, day, long}
+	if warns := il.warnings(); len(warns) != 1 || warns[0].Error() != "interval 2: 24h0m0s is not a multiple of the previous interval 5h0m0s" {
+		t.Errorf("warnings(%v) got %v", il, warns)
+	}
+	if errs := il.validate(); errs != nil {
+		t.Errorf("validate(%v) got %v, uneven intervals are only a warning", il, errs)
+	}
+}
+
+func TestReadScheduleFileLenient(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, _ := ioutil.TempDir("", "snaprd_testing")
+	defer os.RemoveAll(dir)
+	// accepted by earlier versions, a year is no multiple of 4 weeks
+	file := filepath.Join(dir, "snaprd.schedules")
+	ioutil.WriteFile(file, []byte(`{"old": ["6h", "1d", "1w", "4w", "1y", "forever"]}`), 0644)
+	schl := make(scheduleList)
+	if err := schl.addFromFile(file); err != nil || schl["old"] == nil {
+		t.Errorf("addFromFile() rejected a schedule with uneven intervals: %v", err)
+	}
+	if err := checkScheduleFile(file); err == nil {
+		t.Errorf("checkScheduleFile() accepted a schedule with uneven intervals")
+	}
+}
+
+func TestReadScheduleFile(t *testing.T) {
+	read, invalid, err := readScheduleFile("testdata/broken.schedules", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, scheduleList{"good": {hour, day, long}}) {
+		t.Errorf("got valid schedules %v", read)
+	}
+	want := []string{
+		"schedule endless: interval 2: missing terminal interval long",
+		"schedule fraction: interval 1: h is not an integer: 1.5",
+		"schedule mixed: interval 2: long can not be combined with other units",
+		"schedule shrinking: interval 2: 6h0m0s is not longer than the previous interval 24h0m0s",
+		"schedule typo: interval 2: unknown unit \"dya\"",
+		"schedule uneven: interval 2: 24h0m0s is not a multiple of the previous interval 5h0m0s",
+		"schedule zero: interval 1: must be positive, got 0s",
+	}
+	var got []string
+	for _, e := range invalid {
+		got = append(got, e.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAddFromFileInvalid(t *testing.T) {
+	schl := make(scheduleList)
+	err := schl.addFromFile("testdata/broken.schedules")
+	if err == nil {
+		t.Fatal("expected an error for an invalid schedule file")
+	}
+	if len(schl) != 0 {
+		t.Errorf("schedules of an invalid file have been added: %v", schl)
+	}
+}
+
+func TestIntervalSpecs(t *testing.T) {
+	var ji jsonInterval
+	err := json.Unmarshal([]byte(`["6h", {"d": 1}, "1w", "1M", "forever"]`), &ji)
+	if err != nil {
+		t.Fatal(err)
+	}
+	il, errs := ji.intervalList()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	wanted := intervalList{hour * 6, day, week, month, long}
+	if !reflect.DeepEqual(il, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, il)
+	}
+	err = json.Unmarshal([]byte(`["6h", "1dya", "", "forever"]`), &ji)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errs = ji.intervalList()
+	want := "[interval 2: unknown unit dya in time span: 1dya interval 3: empty]"
+	if fmt.Sprint(errs) != want {
+		t.Errorf("got %v, expected %s", errs, want)
+	}
+}
+
+func TestSchedulesAddFromTOMLFile(t *testing.T) {
+	schl := make(scheduleList)
+	err := schl.addFromFile("testdata/snaprd.schedules.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := scheduleList{
+		"test1": {day, week, month, long},
+		"mixed": {hour, day, week, long},
+	}
+	if !reflect.DeepEqual(schl, wanted) {
+		t.Errorf("wanted %v, got %v", wanted, schl)
+	}
+}
+
+func TestFormatSpan(t *testing.T) {
+	tests := map[time.Duration]string{
+		second * 10:          "10s",
+		minute*4 + second*40: "4m40s",
+		day + hour*12:        "1d12h",
+		month + week + day:   "1M1w1d",
+		year + week:          "1y1w",
+		long:                 "forever",
+	}
+	for d, want := range tests {
+		if got := formatSpan(d); got != want {
+			t.Errorf("formatSpan(%v) got %s, expected %s", d, got, want)
+		}
+		if d == long {
+			continue
+		}
+		if back, err := parseSpan(formatSpan(d)); err != nil || back != d {
+			t.Errorf("parseSpan(formatSpan(%v)) got %v, %v", d, back, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Forecast of snapshot counts and disk usage for a schedule
+// The real pruning logic is run against a virtual repository in simulated
+// time.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var sizeSpec = regexp.MustCompile(`^([0-9.]+)\s*([KMGTP]?)(i?B)?$`)
+
+// parseSize converts a string like "500GiB" or "5G" into a number of bytes.
+// All units are binary, so "1G" and "1GiB" are the same.
+func parseSize(s string) (int64, error) {
+	m := sizeSpec.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("malformed size: %s", s)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range "KMGTP" {
+		if m[2] == "" {
+			break
+		}
+		f *= 1024
+		if string(p) == m[2] {
+			break
+		}
+	}
+	return int64(f), nil
+}
+
+// simResult holds the outcome of a simulation.
+type simResult struct {
+	counts        []int // number of snapshots per interval at the end
+	total         int
+	peakTotal     int
+	footprint     int64
+	peakFootprint int64
+}
+
+// estimateFootprint returns the disk usage of the given snapshots. It is
+// assumed that the size of the origin stays the same and the daily changes
+// replace existing data. So the youngest snapshot takes initialSize, and all
+// others take the amount of data that changed until the next snapshot.
+func estimateFootprint(sl snapshotList, initialSize, dailyChange int64) int64 {
+	if len(sl) == 0 {
+		return 0
+	}
+	fp := initialSize
+	for i := 0; i < len(sl)-1; i++ {
+		gap := sl[i+1].startTime.Sub(sl[i].startTime)
+		changed := int64(float64(dailyChange) * gap.Hours() / 24)
+		if changed > initialSize {
+			changed = initialSize
+		}
+		fp += changed
+	}
+	return fp
+}
+
+// simulate creates snapshots at the pace of the first interval for the given
+// duration and prunes them like the run subcommand would.
+func simulate(intervals intervalList, maxKeep int, duration time.Duration, initialSize, dailyChange int64) simResult {
+	var res simResult
+	cl := newVirtualClock(0)
+	end := cl.Now().Add(duration)
+	snapshots := make(snapshotList, 0, 256)
+	for {
+		snapshots = append(snapshots, newSnapshot(cl.Now(), cl.Now().Add(time.Second), stateComplete))
+		// like in the create loop, pruning happens after the snapshot is done
+		cl.forward(time.Second)
+		obsolete := make(map[*snapshot]bool)
+		for _, d := range sieve(snapshots, intervals, maxKeep, nil, nil, cl) {
+			obsolete[d.sn] = true
+		}
+		kept := snapshots[:0]
+		for _, sn := range snapshots {
+			if !obsolete[sn] {
+				kept = append(kept, sn)
+			}
+		}
+		snapshots = kept
+		if len(snapshots) > res.peakTotal {
+			res.peakTotal = len(snapshots)
+		}
+		if fp := estimateFootprint(snapshots, initialSize, dailyChange); fp > res.peakFootprint {
+			res.peakFootprint = fp
+		}
+		if !cl.Now().Add(intervals[0]).Before(end) {
+			break
+		}
+		cl.forward(intervals[0] - time.Second)
+	}
+	res.counts = make([]int, len(intervals)-1)
+	for n := range res.counts {
+		res.counts[n] = len(snapshots.interval(intervals, n, cl))
+	}
+	res.total = len(snapshots)
+	res.footprint = estimateFootprint(snapshots, initialSize, dailyChange)
+	return res
+}
+
+// subcmdSimulate prints the expected number of snapshots and disk usage for
+// the selected schedule.
+func subcmdSimulate() {
+	intervals := schedules[config.Schedule]
+	res := simulate(intervals, config.MaxKeep, config.simDuration, config.simInitialSize, config.simDailyChange)
+	fmt.Printf("### Schedule: %s, simulated time: %.0f days\n", config.Schedule, config.simDuration.Hours()/24)
+	for n := len(intervals) - 2; n >= 0; n-- {
+		if n < len(intervals)-2 {
+			fmt.Printf("every %s from %s ago: %d/%d\n", intervals[n], intervals.offset(n+1), res.counts[n], intervals.goal(n))
+		} else if config.MaxKeep != 0 {
+			fmt.Printf("every %s from past: %d/%d\n", intervals[n], res.counts[n], config.MaxKeep)
+		} else {
+			fmt.Printf("every %s from past: %d/∞\n", intervals[n], res.counts[n])
+		}
+	}
+	fmt.Printf("snapshots: %d (peak %d)\n", res.total, res.peakTotal)
+	fmt.Printf("disk usage: %s (peak %s), with %s initial size and %s daily changes\n",
+		humanBytes(res.footprint), humanBytes(res.peakFootprint),
+		humanBytes(config.simInitialSize), humanBytes(config.simDailyChange))
+}
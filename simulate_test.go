@@ -0,0 +1,67 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"512B":    512,
+		"1K":      1024,
+		"1.5KiB":  1536,
+		"5GiB":    5 * GiB,
+		"500G":    500 * GiB,
+		"2TiB":    2048 * GiB,
+		"1 GiB":   GiB,
+		"0.5 TiB": 512 * GiB,
+	}
+	for s, wanted := range tests {
+		got, err := parseSize(s)
+		if err != nil || got != wanted {
+			t.Errorf("parseSize(%q) = %d, %v, wanted %d", s, got, err, wanted)
+		}
+	}
+	for _, s := range []string{"", "GiB", "5XB", "-1G", "1,5G"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) did not fail, but it should", s)
+		}
+	}
+}
+
+func TestEstimateFootprint(t *testing.T) {
+	sl := snapshotList{
+		newSnapshot(time.Unix(0, 0), time.Unix(1, 0), stateComplete),
+		newSnapshot(time.Unix(0, 0).Add(day), time.Unix(1, 0), stateComplete),
+		newSnapshot(time.Unix(0, 0).Add(day*3), time.Unix(1, 0), stateComplete),
+		newSnapshot(time.Unix(0, 0).Add(day*103), time.Unix(1, 0), stateComplete),
+	}
+	// 100 + 1*5 + 2*5 + min(100*5, 100)
+	if fp := estimateFootprint(sl, 100*GiB, 5*GiB); fp != 215*GiB {
+		t.Errorf("estimateFootprint() = %s, wanted 215GiB", humanBytes(fp))
+	}
+	if fp := estimateFootprint(nil, 100*GiB, 5*GiB); fp != 0 {
+		t.Errorf("estimateFootprint() of empty list = %d, wanted 0", fp)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	schedules.addFromFile("testdata/snaprd.schedules")
+	intervals := schedules["testing2"]
+	res := simulate(intervals, 2, time.Hour, 10*GiB, GiB)
+	// all intervals are filled up to their goal
+	if wanted := []int{4, 2, 2, 2}; !reflect.DeepEqual(res.counts, wanted) {
+		t.Errorf("simulate() counts = %v, wanted %v", res.counts, wanted)
+	}
+	if res.total != 10 {
+		t.Errorf("simulate() total = %d, wanted 10", res.total)
+	}
+	if res.peakTotal < res.total || res.peakFootprint < res.footprint || res.footprint < 10*GiB {
+		t.Errorf("simulate() gave implausible result %+v", res)
+	}
+}
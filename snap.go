@@ -25,6 +25,7 @@ const (
 	stateComplete
 	stateObsolete
 	statePurging
+	statePartial
 	any = (1 << iota) - 1
 )
 
@@ -38,6 +39,8 @@ func (st snapshotState) String() string {
 		return "Obsolete"
 	case statePurging:
 		return "Purging"
+	case statePartial:
+		return "Partial"
 	}
 	return "Unknown"
 }
@@ -75,17 +78,39 @@ func (s *snapshot) Name() string {
 		return fmt.Sprintf("%d-%d-obsolete", stime, etime)
 	case statePurging:
 		return fmt.Sprintf("%d-%d-purging", stime, etime)
+	case statePartial:
+		return fmt.Sprintf("%d-%d-partial", stime, etime)
 	}
 	return fmt.Sprintf("%d-%d-unknown", stime, etime)
 }
 
 // FullName returns the full pathname for the receiver snapshot.
 func (s *snapshot) FullName() string {
+	config := currentConfig()
 	return filepath.Join(config.repository, dataSubdir, s.Name())
 }
 
 // transComplete transitions the receiver to complete state.
 func (s *snapshot) transComplete(cl clock) error {
+	err := s.transFinished(cl, stateComplete)
+	if err != nil {
+		return err
+	}
+	updateSymlinks()
+	overwriteSymlink(filepath.Join(dataSubdir, s.Name()), filepath.Join(config.repository, "latest"))
+	return nil
+}
+
+// transPartial transitions the receiver to partial state. Partial snapshots
+// are finished, but rsync could not transfer everything. They are never used
+// as base for the next snapshot.
+func (s *snapshot) transPartial(cl clock) error {
+	return s.transFinished(cl, statePartial)
+}
+
+// transFinished sets the end time of the receiver and transitions it to the
+// given state.
+func (s *snapshot) transFinished(cl clock, state snapshotState) error {
 	oldName := s.FullName()
 	etime := cl.Now()
 	if etime.Before(s.startTime) {
@@ -96,17 +121,15 @@ func (s *snapshot) transComplete(cl clock) error {
 		etime = etime.Add(time.Second)
 	}
 	s.endTime = etime
-	s.state = stateComplete
+	s.state = state
 	newName := s.FullName()
-	debugf("renaming complete snapshot %s -> %s", oldName, newName)
+	debugf("renaming %s snapshot %s -> %s", strings.ToLower(state.String()), oldName, newName)
 	if oldName != newName {
 		err := os.Rename(oldName, newName)
 		if err != nil {
 			return err
 		}
 	}
-	updateSymlinks()
-	overwriteSymlink(filepath.Join(dataSubdir, s.Name()), filepath.Join(config.repository, "latest"))
 	return nil
 }
 
@@ -166,10 +189,16 @@ func (s *snapshot) purge() {
 	}
 	path := s.FullName()
 	log.Println("purging", s.Name())
+	start := time.Now()
 	err = os.RemoveAll(path)
 	if err != nil {
 		log.Printf("error when purging \"%s\" (ignored): %s", s.Name(), err)
 	}
+	err = os.Remove(s.metaName())
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error when removing metadata of \"%s\" (ignored): %s", s.Name(), err)
+	}
+	metrics.purged(time.Since(start))
 	log.Println("finished purging", s.Name())
 }
 
@@ -239,6 +268,8 @@ func parseSnapshotName(s string) (time.Time, time.Time, snapshotState, error) {
 		state = stateObsolete
 	case "purging":
 		state = statePurging
+	case "partial":
+		state = statePartial
 	}
 	if state == 0 {
 		return time.Unix(stime, 0), time.Unix(etime, 0), state, errors.New("could not parse state: " + s)
@@ -264,6 +295,7 @@ func (sl snapshotListByStartTime) Less(i, j int) bool {
 // findSnapshots() reads the repository directory and returns a list of
 // Snapshot pointers for all valid snapshots it could find.
 func findSnapshots(cl clock) (snapshotList, error) {
+	config := currentConfig()
 	snapshots := make(snapshotList, 0, 256)
 	dataPath := filepath.Join(config.repository, dataSubdir, "")
 	files, err := ioutil.ReadDir(dataPath)
@@ -321,14 +353,15 @@ func (sl snapshotList) state(include, exclude snapshotState) snapshotList {
 	return slNew
 }
 
-// findDangling returns a list of obsolete or purged snapshots.
+// findDangling returns a list of obsolete or purged snapshots, except those
+// that have been pinned.
 func findDangling(cl clock) snapshotList {
 	snapshots, err := findSnapshots(cl)
 	if err != nil {
 		log.Println(err)
 	}
 	slNew := make(snapshotList, 0, len(snapshots))
-	for _, sn := range snapshots.state(stateObsolete+statePurging, stateComplete) {
+	for _, sn := range snapshots.state(stateObsolete+statePurging, stateComplete).unpinned() {
 		debugf("found dangling snapshot: %s", sn)
 		slNew = append(slNew, sn)
 	}
@@ -349,6 +382,25 @@ func lastGoodFromDisk(cl clock) *snapshot {
 	return sn
 }
 
+// lastBaseFromDisk lists the snapshots in the repository and returns a
+// pointer to the youngest complete snapshot, to be used as base for a new
+// one. If there is no complete snapshot, the youngest partial one is used,
+// so rsync does not have to copy everything again.
+func lastBaseFromDisk(cl clock) *snapshot {
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		log.Println(err)
+	}
+	if sn := snapshots.state(stateComplete, none).lastGood(); sn != nil {
+		return sn
+	}
+	sn := snapshots.state(statePartial, none).last()
+	if sn == nil {
+		log.Println("lastgood: could not find suitable base snapshot")
+	}
+	return sn
+}
+
 // lastIncompleteFromDisk lists the snapshots in the repository and returns a pointer
 // to the youngest incomplete snapshot, for possible reuse.
 func lastReusableFromDisk(cl clock) *snapshot {
@@ -165,6 +165,10 @@ func TestParseSnapshotName(t *testing.T) {
 			"1400337721-1400337722-obsolete",
 			&snapshot{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateObsolete},
 		},
+		{
+			"1400337721-1400337722-partial",
+			&snapshot{time.Unix(1400337721, 0), time.Unix(1400337722, 0), statePartial},
+		},
 	}
 	for _, pair := range testsGood {
 		stime, etime, state, err := parseSnapshotName(pair.in)
@@ -0,0 +1,112 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Health summary of a repository, usable as a Nagios check
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// Exit codes of Nagios plugins
+const (
+	nagiosOK = iota
+	nagiosWarning
+	nagiosCritical
+	nagiosUnknown
+)
+
+var nagiosNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// repoStatus collects the state of a repository.
+type repoStatus struct {
+	code    int
+	summary []string
+	details []string
+}
+
+// raise sets the exit code to at least code and adds msg to the summary.
+func (st *repoStatus) raise(code int, msg string) {
+	if code > st.code {
+		st.code = code
+	}
+	st.summary = append(st.summary, msg)
+}
+
+func (st *repoStatus) detail(format string, args ...interface{}) {
+	st.details = append(st.details, fmt.Sprintf(format, args...))
+}
+
+// checkStatus examines the repository. The age of the last complete snapshot
+// is compared to the first interval of the schedule times warnFactor and
+// critFactor.
+func checkStatus(warnFactor, critFactor float64, cl clock) *repoStatus {
+	st := new(repoStatus)
+	if li := lockHolder(config.repository); li != nil {
+		st.detail("daemon: running, %s", li)
+	} else {
+		st.raise(nagiosCritical, "no daemon running")
+		st.detail("daemon: not running")
+	}
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		st.raise(nagiosUnknown, err.Error())
+		return st
+	}
+	if sn := snapshots.state(stateIncomplete, none).last(); sn != nil {
+		st.detail("in progress: %s, started %s ago", sn.Name(), cl.Now().Sub(sn.startTime).Truncate(time.Second))
+	} else {
+		st.detail("in progress: none")
+	}
+	interval := schedules[config.Schedule][0]
+	if sn := snapshots.state(stateComplete, none).lastGood(); sn != nil {
+		age := cl.Now().Sub(sn.startTime)
+		msg := fmt.Sprintf("last complete snapshot %s ago", age.Truncate(time.Second))
+		st.detail("last complete: %s, started %s ago", sn.Name(), age.Truncate(time.Second))
+		switch {
+		case age > time.Duration(float64(interval)*critFactor):
+			st.raise(nagiosCritical, msg+", overdue")
+		case age > time.Duration(float64(interval)*warnFactor):
+			st.raise(nagiosWarning, msg+", overdue")
+		default:
+			st.raise(nagiosOK, msg)
+		}
+	} else {
+		st.raise(nagiosCritical, "no complete snapshot")
+		st.detail("last complete: none")
+	}
+	st.detail("schedule: %s, every %s", config.Schedule, interval)
+	st.detail("dangling: %d obsolete or purging snapshots", len(findDangling(cl)))
+	if sizeBytes, freeBytes, err := freeSpace(config.repository); err == nil {
+		st.detail("free space: %s of %s (%.1f%%)", humanBytes(int64(freeBytes)), humanBytes(int64(sizeBytes)),
+			100*float64(freeBytes)/float64(sizeBytes))
+	} else {
+		st.detail("free space: unknown (%s)", err)
+	}
+	if !checkFreeSpace(config.repository, config.MinPercSpace, config.MinGiBSpace) {
+		st.raise(nagiosWarning, "not enough free space")
+	}
+	return st
+}
+
+// subcmdStatus prints the health of the repository and returns the exit code
+// in the convention of Nagios plugins.
+func subcmdStatus(cl clock) int {
+	if cl == nil {
+		cl = new(realClock)
+	}
+	// findSnapshots and friends complain on the log, which would end up in
+	// the output of the check
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(logger.Writer())
+	st := checkStatus(config.statusWarn, config.statusCrit, cl)
+	fmt.Printf("SNAPRD %s - %s\n", nagiosNames[st.code], strings.Join(st.summary, ", "))
+	for _, d := range st.details {
+		fmt.Println(d)
+	}
+	return st.code
+}
@@ -0,0 +1,52 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	mockConfig()
+	mockRepository()
+	defer os.RemoveAll(config.repository)
+	schedules.addFromFile(config.SchedFile)
+	rl := newRepoLocker(config.repository)
+	if err := rl.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last complete snapshot started at startAt-1, every 5s is expected
+	tests := []struct {
+		forward time.Duration
+		code    int
+	}{
+		{0, nagiosOK},
+		{time.Second * 8, nagiosWarning},
+		{time.Second * 15, nagiosCritical},
+	}
+	for _, tt := range tests {
+		cl := newVirtualClock(startAt)
+		cl.forward(tt.forward)
+		st := checkStatus(1.5, 3, cl)
+		if st.code != tt.code {
+			t.Errorf("checkStatus() after %s = %s (%v), wanted %s",
+				tt.forward, nagiosNames[st.code], st.summary, nagiosNames[tt.code])
+		}
+	}
+	cl := newVirtualClock(startAt)
+	st := checkStatus(1.5, 3, cl)
+	if details := strings.Join(st.details, "\n"); !strings.Contains(details, "daemon: running, pid "+strconv.Itoa(os.Getpid())) ||
+		!strings.Contains(details, "last complete: 1400337721-1400337722-complete") {
+		t.Errorf("checkStatus() details incomplete:\n%s", details)
+	}
+
+	rl.Unlock()
+	if st := checkStatus(1.5, 3, cl); st.code != nagiosCritical {
+		t.Errorf("checkStatus() without daemon = %s, wanted CRITICAL", nagiosNames[st.code])
+	}
+}
@@ -0,0 +1,90 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Detection of missed snapshots
+// snaprd keeps running if rsync fails with ignored errors or hangs, so the
+// repository itself is checked for a recent enough complete snapshot.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type watchdog struct {
+	started time.Time // used as reference until there is a complete snapshot
+	overdue bool
+}
+
+func newWatchdog(cl clock) *watchdog {
+	return &watchdog{started: cl.Now()}
+}
+
+// checkOverdue returns the start time of the last complete snapshot and if it
+// is older than the first interval of the schedule times -overdueFactor.
+func (w *watchdog) checkOverdue(cl clock) (last time.Time, overdue bool) {
+	config, schedules := currentSettings()
+	snapshots, err := findSnapshots(cl)
+	if err != nil {
+		log.Println(err)
+	}
+	last = w.started
+	if sn := snapshots.state(stateComplete, none).lastGood(); sn != nil {
+		last = sn.startTime
+	}
+	limit := time.Duration(float64(schedules[config.Schedule][0]) * config.OverdueFactor)
+	return last, cl.Now().Sub(last) > limit
+}
+
+// check sends a notification when the repository becomes overdue, and again
+// when it has recovered.
+func (w *watchdog) check(cl clock) {
+	config, schedules := currentSettings()
+	last, overdue := w.checkOverdue(cl)
+	if overdue == w.overdue {
+		return
+	}
+	w.overdue = overdue
+	metrics.setOverdue(overdue)
+	since := cl.Now().Sub(last).Truncate(time.Second)
+	if overdue {
+		msg := fmt.Sprintf("no snapshot has been completed for %s (since %s).\nThe schedule expects one every %s.",
+			since, last.Format("2006-01-02 15:04:05"), schedules[config.Schedule][0])
+		log.Println("repository is overdue:", msg)
+		notifyEvent("overdue", fmt.Sprintf("snaprd snapshot overdue (origin: %s)", config.Origin), msg)
+	} else {
+		msg := fmt.Sprintf("snapshots are being completed again, the last one started %s ago.", since)
+		log.Println("repository recovered:", msg)
+		notifyEvent("recovered", fmt.Sprintf("snaprd snapshot recovered (origin: %s)", config.Origin), msg)
+	}
+}
+
+// runWatchdog checks the repository once per interval while -overdueFactor
+// is set. The ticker is started again when the settings are reloaded, to
+// follow a changed schedule. It never returns.
+func runWatchdog(cl clock, reload <-chan struct{}) {
+	w := newWatchdog(cl)
+	for {
+		config, schedules := currentSettings()
+		if config.OverdueFactor <= 0 {
+			if w.overdue {
+				w.overdue = false
+				metrics.setOverdue(false)
+			}
+			<-reload
+			continue
+		}
+		tick := time.NewTicker(schedules[config.Schedule][0])
+	WAIT:
+		for {
+			select {
+			case <-tick.C:
+				w.check(cl)
+			case <-reload:
+				break WAIT
+			}
+		}
+		tick.Stop()
+	}
+}
@@ -0,0 +1,56 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	ts, received := webhookStandIn(0)
+	defer ts.Close()
+	mockWebhookConfig(ts.URL)
+	defer os.RemoveAll(config.repository)
+	mockRepository()
+	schedules.addFromFile(config.SchedFile)
+	config.OverdueFactor = 3
+	// the youngest mock snapshot started at startAt-1
+	cl := newVirtualClock(startAt)
+	w := newWatchdog(cl)
+
+	expectEvent := func(want string) {
+		t.Helper()
+		if want == "" {
+			if len(received) != 0 {
+				t.Errorf("got notification %q, wanted none", (<-received).Event)
+			}
+			return
+		}
+		select {
+		case p := <-received:
+			if p.Event != want {
+				t.Errorf("got notification %q, wanted %q", p.Event, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Errorf("no notification received, wanted %q", want)
+		}
+	}
+
+	w.check(cl)
+	expectEvent("")
+	cl.forward(time.Second * 15)
+	w.check(cl)
+	expectEvent("overdue")
+	// only notify once
+	cl.forward(time.Second * 15)
+	w.check(cl)
+	time.Sleep(time.Millisecond * 100)
+	expectEvent("")
+	// a new snapshot ends the overdue state
+	os.MkdirAll(filepath.Join(config.repository, dataSubdir, "1400337750-1400337751-complete"), 0777)
+	w.check(cl)
+	expectEvent("recovered")
+}